@@ -2,8 +2,12 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/blinry/goyaml"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
 type LoggingConfig struct {
@@ -12,6 +16,7 @@ type LoggingConfig struct {
 	Level         string "level"
 	Filename      string "filename"
 	ErrorFilename string "errorfilename"
+	SlowFilename  string "slowfilename" //slow query log, empty:the main log
 	Maxsize       int    "maxsize"
 	Maxrolls      int    "maxrolls"
 }
@@ -20,6 +25,7 @@ var defaultLoggingConfig = LoggingConfig{
 	Level:         "debug",
 	Filename:      "/home/eop/gopath/src/server/log/server.log",
 	ErrorFilename: "/home/eop/gopath/src/server/log/server_err.log",
+	SlowFilename:  "/home/eop/gopath/src/server/log/server_slow.log",
 	Maxsize:       100000,
 	Maxrolls:      5,
 }
@@ -32,48 +38,85 @@ var defaultDaemonConfig = DaemonConfig{
 	Switch: "off",
 }
 
+/*
+HttpServerConfig serves https when CertFile is set. ClientCAFile turns on
+mutual TLS, ClientAuth defaults to require_and_verify then.
+*/
 type HttpServerConfig struct {
-	Switch string "switch"
-	Ip     string "ip"
-	Port   uint16 "port"
+	Switch        string "switch"
+	Ip            string "ip"
+	Port          uint16 "port"
+	CertFile      string "cert_file"
+	KeyFile       string "key_file"
+	MinTLSVersion string "min_tls_version" //1.0, 1.1, 1.2, 1.3
+	Ciphers       string "ciphers"         //default, intermediate: ECDHE with AEAD only
+	ClientCAFile  string "client_ca_file"
+	ClientAuth    string "client_auth" //none, request, require, verify_if_given, require_and_verify
 }
 
 var defaultHttpServerConfig = HttpServerConfig{
-	Switch: "on",
-	Ip:     "0.0.0.0",
-	Port:   8888,
+	Switch:        "on",
+	Ip:            "0.0.0.0",
+	Port:          8888,
+	MinTLSVersion: "1.2",
+	Ciphers:       "default",
 }
 
-type PprofConfig struct {
-	Switch string "switch"
-	Ip     string "ip"
-	Port   uint16 "port"
+/*
+AdminConfig is the listener of the operational routes, protected by
+a bearer token, basic auth with user and password, or both.
+*/
+type AdminConfig struct {
+	Switch   string "switch"
+	Ip       string "ip"
+	Port     uint16 "port"
+	Token    string `yaml:"token" secret:"true"`
+	User     string "user"
+	Password string `yaml:"password" secret:"true"`
+	Pprof    string "pprof" //on:serve net/http/pprof on /debug/pprof
 }
 
-var defaultPprofConfig = PprofConfig{
+var defaultAdminConfig = AdminConfig{
 	Switch: "off",
-	Ip:     "0.0.0.0",
-	Port:   8888,
+	Ip:     "127.0.0.1",
+	Port:   8889,
+	Pprof:  "off",
 }
 
 type DBItemConfig struct {
-	DBName         string "DBName"
-	DriverName     string "DriverName"
-	DataSourceName string "DataSourceName"
-	MaxIdleConns   int    "MaxIdleConns"
-	MaxOpenConns   int    "MaxOpenConns"
+	DBName           string   "DBName"
+	DriverName       string   "DriverName"
+	Required         string   "Required" //off:/readyz doesn't wait for it, default on
+	DataSourceName   string   `yaml:"DataSourceName" secret:"dsn"`
+	FallbackDSNs     []string `yaml:"FallbackDSNs" secret:"dsn"` //tried in order when DataSourceName is down
+	Failback         string   "Failback"                         //on:go back to DataSourceName, default off
+	FailbackAfter    int      "FailbackAfter"                    //seconds DataSourceName must be up before failback
+	Replicas         []string `yaml:"Replicas" secret:"dsn"`     //reads go here, writes to DataSourceName
+	ReplicaPolicy    string   "ReplicaPolicy"                    //round_robin(default), least_conn
+	MaxIdleConns     int      "MaxIdleConns"
+	MaxOpenConns     int      "MaxOpenConns"
+	StatementTimeout int      "StatementTimeout" //seconds, 0:no timeout, not applied to Iterate
+	StmtCacheSize    int      "StmtCacheSize"    //prepared statements kept, 0:no cache
+	SlowThreshold    int      "SlowThreshold"    //milliseconds, 0:no slow query log
+	FastSampleRate   float64  "FastSampleRate"   //0~1, share of the other queries logged too
 }
 
 type DBServerConfig struct {
 	Switch                  string         "switch"
 	LogSQLExecuteTimeSwitch string         "log_sql_execute_time_switch"
-	ConnCheckInterval       int            "conn_check_interval"
+	ConnCheckInterval       int            "conn_check_interval"    //seconds, 0:no check
+	ConnCheckTimeout        int            "conn_check_timeout"     //seconds, 0:no timeout
+	ConnCheckMaxBackoff     int            "conn_check_max_backoff" //seconds
+	MigrationsDir           string         "migrations_dir"         //migrations of a dbitem are in MigrationsDir/DBName
 	DBItems                 []DBItemConfig "dbitems"
 }
 
 var defaultDBServerConfig = DBServerConfig{
 	Switch:                  "on",
 	LogSQLExecuteTimeSwitch: "on",
+	ConnCheckTimeout:        3,
+	ConnCheckMaxBackoff:     60,
+	MigrationsDir:           "migrations",
 }
 
 type IntervalsConfig struct {
@@ -88,63 +131,176 @@ var defaultIntervalsConfig = IntervalsConfig{
 	AgentInfo_Refresh_Interval:      3,
 }
 
+type ShutdownConfig struct {
+	Delay   int "delay" //seconds /readyz fails before the listeners close
+	Timeout int "timeout"
+}
+
+var defaultShutdownConfig = ShutdownConfig{
+	Delay:   5,
+	Timeout: 30,
+}
+
 type Config struct {
 	Logging    LoggingConfig    "logging"
 	Daemon     DaemonConfig     "daemon"
 	HttpServer HttpServerConfig "httpserver"
-	Pprof      PprofConfig      "pprof"
+	Admin      AdminConfig      "admin"
 	DBServer   DBServerConfig   "dbserver"
 	Intervals  IntervalsConfig  "intervals"
+	Shutdown   ShutdownConfig   "shutdown"
+
+	origins map[string]string //key -> where the effective value came from
 }
 
 var defaultConfig = Config{
 	Logging:    defaultLoggingConfig,
 	Daemon:     defaultDaemonConfig,
 	HttpServer: defaultHttpServerConfig,
-	Pprof:      defaultPprofConfig,
+	Admin:      defaultAdminConfig,
 	DBServer:   defaultDBServerConfig,
 	Intervals:  defaultIntervalsConfig,
+	Shutdown:   defaultShutdownConfig,
 }
 
+/*
+config is replaced on every reload while the handlers read it, configLock
+guards it. Callers get copies, the current config is never changed in place.
+*/
 var config Config
+var configLock sync.RWMutex
+var configPath string
 
 func DefaultConfig() *Config {
 	//c := defaultConfig
 	//return &c
-	config = Config{
+	c := Config{
 		Logging:    defaultLoggingConfig,
 		Daemon:     defaultDaemonConfig,
 		HttpServer: defaultHttpServerConfig,
-		Pprof:      defaultPprofConfig,
+		Admin:      defaultAdminConfig,
 		DBServer:   defaultDBServerConfig,
 		Intervals:  defaultIntervalsConfig,
+		Shutdown:   defaultShutdownConfig,
 	}
-	return &config
+	SetCurConfig(&c)
+	return &c
 }
 
-func InitConfigFromFile(path string) *Config {
-	var c *Config = DefaultConfig()
-	var e error
-
-	b, e := ioutil.ReadFile(path)
+func InitConfigFromFile(path string, sets ...string) (*Config, error) {
+	c, e := LoadConfigFromFile(path, sets...)
 	if e != nil {
-		panic(e.Error())
+		return nil, e
 	}
 
-	e = goyaml.Unmarshal(b, c)
-	if e != nil {
-		panic(e.Error())
+	SetCurConfig(c)
+	if path != "" {
+		configPath, _ = filepath.Abs(path)
+	}
+	return c, nil
+}
+
+/*
+ConfigPath is the absolute path of the config file the server started
+with, empty when it runs on the defaults.
+*/
+func ConfigPath() string {
+	return configPath
+}
+
+/*
+LoadConfigFromFile reads a config without touching the current one,
+so a bad file can be rejected while the server keeps running.
+An empty path loads the defaults. Environment variables and sets
+(key=value) are applied on top, see override.go for the precedence.
+Secret references are resolved last, see secretref.go.
+A config that fails Validate is returned with the ValidationErrors.
+*/
+func LoadConfigFromFile(path string, sets ...string) (*Config, error) {
+	c := defaultConfig
+	origins := make(map[string]string)
+
+	if path != "" {
+		b, e := ioutil.ReadFile(path)
+		if e != nil {
+			return nil, e
+		}
+
+		e = goyaml.Unmarshal(b, &c)
+		if e != nil {
+			return nil, fmt.Errorf("parse %s error:%s", path, e.Error())
+		}
+
+		keys, e := fileKeys(b)
+		if e != nil {
+			return nil, fmt.Errorf("parse %s error:%s", path, e.Error())
+		}
+		for _, f := range configFields(&c) {
+			if keys[strings.ToLower(f.key)] {
+				origins[f.key] = OriginFile
+			}
+		}
 	}
 
-	return c
+	errs := c.applyEnv(origins)
+	errs = append(errs, c.applySets(sets, origins)...)
+	if len(errs) > 0 {
+		return &c, errs
+	}
+	c.origins = origins
+
+	errs = c.resolveSecretRefs()
+	errs = append(errs, c.Validate()...)
+	if len(errs) > 0 {
+		return &c, errs
+	}
+
+	return &c, nil
 }
 
 func CurConfig() *Config {
-	return &config
+	configLock.RLock()
+	c := config
+	configLock.RUnlock()
+	return &c
 }
 
+func SetCurConfig(c *Config) {
+	configLock.Lock()
+	config = *c
+	configLock.Unlock()
+	updateSecrets(c)
+}
+
+/*
+ConfigJson and ConfigOriginJson mask secrets, see redact.go.
+*/
 func ConfigJson() string {
-	jsonbyte, err := json.MarshalIndent(config, "", "  ")
+	jsonbyte, err := json.MarshalIndent(CurConfig().Redacted(), "", "  ")
+	if err != nil {
+		return ""
+	} else {
+		return string(jsonbyte)
+	}
+}
+
+/*
+ConfigOriginJson reports every effective value with where it came from:
+default, file, env or flag.
+*/
+func ConfigOriginJson() string {
+	type originValue struct {
+		Value  interface{} `json:"value"`
+		Origin string      `json:"origin"`
+	}
+
+	c := CurConfig().Redacted()
+	values := make(map[string]originValue)
+	for _, f := range configFields(c) {
+		values[f.key] = originValue{Value: f.value.Interface(), Origin: c.Origin(f.key)}
+	}
+
+	jsonbyte, err := json.MarshalIndent(values, "", "  ")
 	if err != nil {
 		return ""
 	} else {
@@ -0,0 +1,248 @@
+package config
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type testDriver struct{}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+func init() {
+	sql.Register("testdriver", testDriver{})
+}
+
+func testConfig() *Config {
+	c := defaultConfig
+	c.DBServer.DBItems = []DBItemConfig{
+		{DBName: "db1", DriverName: "testdriver", DataSourceName: "root:pw@tcp(127.0.0.1:3306)/db1", MaxIdleConns: 5, MaxOpenConns: 10},
+		{DBName: "db2", DriverName: "testdriver", DataSourceName: "/tmp/db2.db", MaxIdleConns: 5, MaxOpenConns: 10},
+	}
+	return &c
+}
+
+func assertPaths(t *testing.T, errs ValidationErrors, paths ...string) {
+	if len(errs) != len(paths) {
+		t.Fatalf("Unexpected validation errors. Found %v, expected paths %v", errs, paths)
+	}
+	for i := range paths {
+		if errs[i].Path != paths[i] {
+			t.Fatalf("Unexpected validation error path. Found %s, expected %s", errs[i].Path, paths[i])
+		}
+	}
+}
+
+func TestValidateDefault(t *testing.T) {
+	if errs := testConfig().Validate(); errs != nil {
+		t.Fatalf("Unexpected validation errors: %v", errs)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	c := testConfig()
+	c.Daemon.Switch = "maybe"
+	c.HttpServer.Port = 0
+	c.DBServer.DBItems[0].MaxIdleConns = 20
+	c.DBServer.DBItems[1].DBName = "db1"
+	c.DBServer.DBItems[1].DriverName = "oracle"
+
+	assertPaths(t, c.Validate(),
+		"daemon.switch",
+		"httpserver.port",
+		"dbserver.dbitems[0].MaxIdleConns",
+		"dbserver.dbitems[1].DBName",
+		"dbserver.dbitems[1].DriverName")
+}
+
+func TestValidateSkipsDisabledListener(t *testing.T) {
+	c := testConfig()
+	c.HttpServer.Switch = "off"
+	c.HttpServer.Port = 0
+	if errs := c.Validate(); errs != nil {
+		t.Fatalf("Unexpected validation errors: %v", errs)
+	}
+}
+
+func TestValidateAdmin(t *testing.T) {
+	c := testConfig()
+	c.Admin.Switch = "on"
+	c.Admin.Ip = "0.0.0.0"
+	c.Admin.Port = c.HttpServer.Port
+	c.Admin.User = "admin"
+	assertPaths(t, c.Validate(), "admin.port", "admin.password")
+
+	c.Admin.Port++
+	c.Admin.User = ""
+	assertPaths(t, c.Validate(), "admin.token")
+
+	c.Admin.Token = "secret"
+	if errs := c.Validate(); errs != nil {
+		t.Fatalf("Unexpected validation errors: %v", errs)
+	}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	f, err := ioutil.TempFile("", "goserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("httpserver:\n  port: 7000\ndbserver:\n  dbitems:\n    - DBName: db1\n      DriverName: testdriver\n      DataSourceName: /tmp/db1.db\n")
+	f.Close()
+
+	os.Setenv("GOSERVER_HTTPSERVER_IP", "127.0.0.1")
+	os.Setenv("GOSERVER_DBSERVER_DBITEMS_DB1_MAXOPENCONNS", "3")
+	os.Setenv("GOSERVER_DBSERVER_DBITEMS_DB1_MAXIDLECONNS", "8")
+	defer os.Unsetenv("GOSERVER_HTTPSERVER_IP")
+	defer os.Unsetenv("GOSERVER_DBSERVER_DBITEMS_DB1_MAXOPENCONNS")
+	defer os.Unsetenv("GOSERVER_DBSERVER_DBITEMS_DB1_MAXIDLECONNS")
+
+	c, err := LoadConfigFromFile(f.Name(), "dbserver.dbitems.db1.MaxIdleConns=2")
+	if err != nil {
+		t.Fatalf("Unexpected load error: %s", err.Error())
+	}
+
+	if c.HttpServer.Port != 7000 || c.HttpServer.Ip != "127.0.0.1" || c.DBServer.DBItems[0].MaxIdleConns != 2 {
+		t.Fatalf("Unexpected effective values: %+v %+v", c.HttpServer, c.DBServer.DBItems[0])
+	}
+
+	origins := map[string]string{
+		"httpserver.switch":                   OriginDefault,
+		"httpserver.port":                     OriginFile,
+		"httpserver.ip":                       OriginEnv,
+		"dbserver.dbitems.db1.MaxOpenConns":   OriginEnv,
+		"dbserver.dbitems.db1.MaxIdleConns":   OriginFlag,
+		"dbserver.dbitems.db1.DataSourceName": OriginFile,
+	}
+	for key, origin := range origins {
+		if c.Origin(key) != origin {
+			t.Fatalf("Unexpected origin of %s. Found %s, expected %s", key, c.Origin(key), origin)
+		}
+	}
+}
+
+func TestOverrideUnknownKey(t *testing.T) {
+	os.Setenv("GOSERVER_HTTPSERVER_PROT", "1")
+	defer os.Unsetenv("GOSERVER_HTTPSERVER_PROT")
+
+	_, err := LoadConfigFromFile("", "dbserver.dbitems.nosuchdb.MaxOpenConns=1")
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Unexpected load error: %v", err)
+	}
+	assertPaths(t, errs, "GOSERVER_HTTPSERVER_PROT", "-set dbserver.dbitems.nosuchdb.MaxOpenConns")
+}
+
+func assertRedactDSN(t *testing.T, dsn, redacted string) {
+	if r := RedactDSN(dsn); r != redacted {
+		t.Fatalf("Unexpected redacted dsn. Found %s, expected %s", r, redacted)
+	}
+}
+
+func TestRedactDSN(t *testing.T) {
+	assertRedactDSN(t, "root:mysql@tcp(10.1.63.78:3306)/eop", "root:******@tcp(10.1.63.78:3306)/eop")
+	assertRedactDSN(t, "root:p@ss@tcp(db:3306)/eop?parseTime=true", "root:******@tcp(db:3306)/eop?parseTime=true")
+	assertRedactDSN(t, "root@tcp(db:3306)/eop", "root@tcp(db:3306)/eop")
+	assertRedactDSN(t, "postgres://app:secret@db:5432/eop", "postgres://app:******@db:5432/eop")
+	assertRedactDSN(t, "/home/eop/a.db", "/home/eop/a.db")
+	assertRedactDSN(t, "file:a.db?_auth&_auth_user=admin&_auth_pass=secret", "file:a.db?_auth&_auth_user=admin&_auth_pass=******")
+}
+
+func TestRedactConfig(t *testing.T) {
+	c := testConfig()
+	r := c.Redacted()
+	if r.DBServer.DBItems[0].DataSourceName != "root:******@tcp(127.0.0.1:3306)/db1" {
+		t.Fatalf("Unexpected redacted config: %s", r.DBServer.DBItems[0].DataSourceName)
+	}
+	if c.DBServer.DBItems[0].DataSourceName != "root:pw@tcp(127.0.0.1:3306)/db1" {
+		t.Fatalf("Redacted changed the original config: %s", c.DBServer.DBItems[0].DataSourceName)
+	}
+
+	c.DBServer.DBItems[1].DataSourceName = "root:s3cretpw@tcp(127.0.0.1:3306)/db2"
+	SetCurConfig(c)
+	defer SetCurConfig(&defaultConfig)
+	if s := RedactString("Error 1045: Access denied for user 'root' (using password: s3cretpw)"); s != "Error 1045: Access denied for user 'root' (using password: ******)" {
+		t.Fatalf("Unexpected redacted string: %s", s)
+	}
+	if s := RedactString("s3cretpw10 is not a password"); s != "s3cretpw10 is not a password" {
+		t.Fatalf("Unexpected redacted string: %s", s)
+	}
+}
+
+func TestRedactShortSecret(t *testing.T) {
+	c := testConfig()
+	c.DBServer.DBItems[0].DataSourceName = "root:mysql@tcp(127.0.0.1:3306)/db1"
+	c.Admin.Token = "1"
+	SetCurConfig(c)
+	defer SetCurConfig(&defaultConfig)
+
+	//short passwords are masked, short all-digit ones are not
+	msg := "db(db1) query error:dial tcp 127.0.0.1:3306: user root password mysql, 1 retry"
+	expected := "db(db1) query error:dial tcp 127.0.0.1:3306: user root password ******, 1 retry"
+	if s := RedactString(msg); s != expected {
+		t.Fatalf("Unexpected redacted string. Found %s, expected %s", s, expected)
+	}
+	r := c.Redacted()
+	if r.DBServer.DBItems[0].DataSourceName != "root:******@tcp(127.0.0.1:3306)/db1" || r.Admin.Token != "******" {
+		t.Fatalf("Unexpected redacted config: %s %s", r.DBServer.DBItems[0].DataSourceName, r.Admin.Token)
+	}
+}
+
+func TestSecretRefs(t *testing.T) {
+	secret, err := ioutil.TempFile("", "goserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secret.Name())
+	secret.WriteString("filepw\n")
+	secret.Close()
+
+	os.Setenv("TEST_MYSQL_PW", "envpw")
+	defer os.Unsetenv("TEST_MYSQL_PW")
+
+	c := testConfig()
+	c.DBServer.DBItems[0].DataSourceName = "root:${file:" + secret.Name() + "}@tcp(db:3306)/db1"
+	c.DBServer.DBItems[1].DataSourceName = "file:db2.db?_auth_pass=${env:TEST_MYSQL_PW}"
+	c.DBServer.DBItems[1].FallbackDSNs = []string{"file:db3.db?_auth_pass=${env:TEST_NOT_SET}"}
+	c.Logging.Filename = "/var/log/${env:TEST_NOT_SET}.log"
+
+	assertPaths(t, c.resolveSecretRefs(), "logging.filename", "dbserver.dbitems[1].FallbackDSNs[0]")
+
+	if c.DBServer.DBItems[0].DataSourceName != "root:filepw@tcp(db:3306)/db1" {
+		t.Fatalf("Unexpected resolved dsn: %s", c.DBServer.DBItems[0].DataSourceName)
+	}
+	if c.DBServer.DBItems[1].DataSourceName != "file:db2.db?_auth_pass=envpw" {
+		t.Fatalf("Unexpected resolved dsn: %s", c.DBServer.DBItems[1].DataSourceName)
+	}
+	if s := c.Redacted().DBServer.DBItems[0].DataSourceName; s != "root:******@tcp(db:3306)/db1" {
+		t.Fatalf("Unexpected redacted dsn: %s", s)
+	}
+}
+
+func TestSetCurConfigConcurrent(t *testing.T) {
+	defer SetCurConfig(&defaultConfig)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c := testConfig()
+			c.HttpServer.Port = uint16(8000 + i)
+			SetCurConfig(c)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		ConfigJson()
+		CurConfig()
+	}
+	<-done
+	if port := CurConfig().HttpServer.Port; port != 8099 {
+		t.Fatalf("Unexpected current port. Found %d, expected 8099", port)
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+/*
+ConfigDiff lists what changed between two configs, grouped by the
+subsystem that has to apply it.
+*/
+type ConfigDiff struct {
+	Logging        bool
+	HttpServer     bool
+	Admin          bool
+	DBServer       bool
+	DBItemsAdded   []DBItemConfig
+	DBItemsRemoved []DBItemConfig
+	DBItemsChanged []DBItemConfig
+	Restart        []string //sections that only take effect after restart
+}
+
+func Diff(oldc, newc *Config) *ConfigDiff {
+	d := &ConfigDiff{}
+
+	d.Logging = oldc.Logging != newc.Logging
+	d.HttpServer = oldc.HttpServer != newc.HttpServer
+	d.Admin = oldc.Admin != newc.Admin
+	d.DBServer = oldc.DBServer.Switch != newc.DBServer.Switch ||
+		oldc.DBServer.LogSQLExecuteTimeSwitch != newc.DBServer.LogSQLExecuteTimeSwitch ||
+		oldc.DBServer.ConnCheckInterval != newc.DBServer.ConnCheckInterval ||
+		oldc.DBServer.ConnCheckTimeout != newc.DBServer.ConnCheckTimeout ||
+		oldc.DBServer.ConnCheckMaxBackoff != newc.DBServer.ConnCheckMaxBackoff
+
+	olditems := make(map[string]DBItemConfig)
+	for _, item := range oldc.DBServer.DBItems {
+		olditems[item.DBName] = item
+	}
+	newitems := make(map[string]bool)
+	for _, item := range newc.DBServer.DBItems {
+		newitems[item.DBName] = true
+		olditem, ok := olditems[item.DBName]
+		if !ok {
+			d.DBItemsAdded = append(d.DBItemsAdded, item)
+		} else if !reflect.DeepEqual(olditem, item) {
+			d.DBItemsChanged = append(d.DBItemsChanged, item)
+		}
+	}
+	for _, item := range oldc.DBServer.DBItems {
+		if !newitems[item.DBName] {
+			d.DBItemsRemoved = append(d.DBItemsRemoved, item)
+		}
+	}
+
+	if oldc.Daemon != newc.Daemon {
+		d.Restart = append(d.Restart, "daemon")
+	}
+	if oldc.Intervals != newc.Intervals {
+		d.Restart = append(d.Restart, "intervals")
+	}
+
+	return d
+}
+
+func (d *ConfigDiff) Empty() bool {
+	return !d.Logging && !d.HttpServer && !d.Admin && !d.DBServer &&
+		len(d.DBItemsAdded) == 0 && len(d.DBItemsRemoved) == 0 && len(d.DBItemsChanged) == 0 &&
+		len(d.Restart) == 0
+}
+
+func (d *ConfigDiff) String() string {
+	if d.Empty() {
+		return "no change"
+	}
+	var changes []string
+	if d.Logging {
+		changes = append(changes, "logging")
+	}
+	if d.HttpServer {
+		changes = append(changes, "httpserver")
+	}
+	if d.Admin {
+		changes = append(changes, "admin")
+	}
+	if d.DBServer {
+		changes = append(changes, "dbserver")
+	}
+	for _, item := range d.DBItemsAdded {
+		changes = append(changes, "+dbitem("+item.DBName+")")
+	}
+	for _, item := range d.DBItemsRemoved {
+		changes = append(changes, "-dbitem("+item.DBName+")")
+	}
+	for _, item := range d.DBItemsChanged {
+		changes = append(changes, "~dbitem("+item.DBName+")")
+	}
+	for _, section := range d.Restart {
+		changes = append(changes, section+"(restart)")
+	}
+	return strings.Join(changes, ", ")
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"testing"
+)
+
+func dbNames(items []DBItemConfig) []string {
+	var names []string
+	for _, item := range items {
+		names = append(names, item.DBName)
+	}
+	return names
+}
+
+func TestDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(c *Config)
+		diff   string
+	}{
+		{"none", func(c *Config) {}, "no change"},
+		{"logging", func(c *Config) { c.Logging.Level = "info" }, "logging"},
+		{"httpserver address", func(c *Config) { c.HttpServer.Port = 9000 }, "httpserver"},
+		{"httpserver tls", func(c *Config) { c.HttpServer.CertFile = "cert.pem" }, "httpserver"},
+		{"admin address", func(c *Config) { c.Admin.Ip = "0.0.0.0" }, "admin"},
+		{"dbserver", func(c *Config) { c.DBServer.ConnCheckInterval = 10 }, "dbserver"},
+		{"dbitem added", func(c *Config) {
+			c.DBServer.DBItems = append(c.DBServer.DBItems, DBItemConfig{DBName: "db3", DriverName: "testdriver"})
+		}, "+dbitem(db3)"},
+		{"dbitem removed", func(c *Config) { c.DBServer.DBItems = c.DBServer.DBItems[:1] }, "-dbitem(db2)"},
+		{"dbitem changed", func(c *Config) {
+			c.DBServer.DBItems = append([]DBItemConfig(nil), c.DBServer.DBItems...)
+			c.DBServer.DBItems[0].MaxOpenConns = 20
+		}, "~dbitem(db1)"},
+		{"dbitem renamed", func(c *Config) {
+			c.DBServer.DBItems = append([]DBItemConfig(nil), c.DBServer.DBItems...)
+			c.DBServer.DBItems[1].DBName = "db3"
+		}, "+dbitem(db3), -dbitem(db2)"},
+		{"daemon", func(c *Config) { c.Daemon.Switch = "on" }, "daemon(restart)"},
+		{"intervals", func(c *Config) { c.Intervals.AgentInfo_Refresh_Interval = 5 }, "intervals(restart)"},
+		{"shutdown", func(c *Config) { c.Shutdown.Delay = 0 }, "no change"},
+	} {
+		oldc, newc := testConfig(), testConfig()
+		tc.change(newc)
+		if d := Diff(oldc, newc).String(); d != tc.diff {
+			t.Fatalf("Unexpected diff of %s. Found %q, expected %q", tc.name, d, tc.diff)
+		}
+	}
+}
+
+func TestDiffDBItems(t *testing.T) {
+	oldc, newc := testConfig(), testConfig()
+	newc.DBServer.DBItems = []DBItemConfig{
+		{DBName: "db2", DriverName: "testdriver", DataSourceName: "/tmp/db2.db", MaxIdleConns: 5, MaxOpenConns: 10},
+		{DBName: "db3", DriverName: "testdriver"},
+	}
+	newc.DBServer.DBItems[0].FallbackDSNs = []string{"/tmp/db2b.db"}
+
+	d := Diff(oldc, newc)
+	for _, tc := range []struct {
+		name     string
+		found    []string
+		expected string
+	}{
+		{"added", dbNames(d.DBItemsAdded), "db3"},
+		{"removed", dbNames(d.DBItemsRemoved), "db1"},
+		{"changed", dbNames(d.DBItemsChanged), "db2"},
+	} {
+		if len(tc.found) != 1 || tc.found[0] != tc.expected {
+			t.Fatalf("Unexpected %s dbitems. Found %v, expected [%s]", tc.name, tc.found, tc.expected)
+		}
+	}
+	if d.DBServer || d.Empty() {
+		t.Fatalf("Unexpected diff: %s", d)
+	}
+}
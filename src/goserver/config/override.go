@@ -0,0 +1,243 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/blinry/goyaml"
+)
+
+/*
+Every config key can be set from four places, a later one wins:
+
+	defaults < config file < environment < -set flags
+
+A key is the yaml path with dbitems addressed by DBName, like
+httpserver.port or dbserver.dbitems.mysql1.DataSourceName. The matching
+environment variable is the key in upper case with dots turned into
+underscores and a GOSERVER_ prefix, like GOSERVER_HTTPSERVER_PORT.
+Only existing dbitems can be overridden, unknown keys are errors.
+*/
+const EnvPrefix = "GOSERVER_"
+
+const (
+	OriginDefault = "default"
+	OriginFile    = "file"
+	OriginEnv     = "env"
+	OriginFlag    = "flag"
+)
+
+type configField struct {
+	key   string
+	path  string //like key with dbitems by index, as in ValidationError
+	value reflect.Value
+}
+
+func configFields(c *Config) []configField {
+	var fields []configField
+	collectFields(reflect.ValueOf(c).Elem(), "", "", &fields)
+	return fields
+}
+
+func collectFields(v reflect.Value, prefix, pathPrefix string, fields *[]configField) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		key := prefix + yamlName(f)
+		path := pathPrefix + yamlName(f)
+		fv := v.Field(i)
+		switch {
+		case fv.Kind() == reflect.Struct:
+			collectFields(fv, key+".", path+".", fields)
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < fv.Len(); j++ {
+				collectFields(fv.Index(j), key+"."+elemName(fv.Index(j), j)+".", fmt.Sprintf("%s[%d].", path, j), fields)
+			}
+		default:
+			*fields = append(*fields, configField{key: key, path: path, value: fv})
+		}
+	}
+}
+
+/*
+yamlName reads both the bare tags used in this package and yaml:"" tags.
+*/
+func yamlName(f reflect.StructField) string {
+	if name := f.Tag.Get("yaml"); name != "" {
+		return name
+	}
+	if f.Tag != "" && !strings.Contains(string(f.Tag), ":") {
+		return string(f.Tag)
+	}
+	return strings.ToLower(f.Name)
+}
+
+func elemName(v reflect.Value, i int) string {
+	if name := v.FieldByName("DBName"); name.IsValid() && name.String() != "" {
+		return name.String()
+	}
+	return strconv.Itoa(i)
+}
+
+func envName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+	return EnvPrefix + strings.ToUpper(name)
+}
+
+func setFieldValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can't set %s", v.Type())
+		}
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("can't set %s", v.Type())
+	}
+	return nil
+}
+
+/*
+fileKeys returns the keys present in a yaml file, lower cased.
+*/
+func fileKeys(b []byte) (map[string]bool, error) {
+	var m map[interface{}]interface{}
+	if err := goyaml.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	collectFileKeys(m, "", keys)
+	return keys, nil
+}
+
+func collectFileKeys(v interface{}, prefix string, keys map[string]bool) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		for k, sub := range v {
+			collectFileKeys(sub, prefix+fmt.Sprint(k)+".", keys)
+		}
+		return
+	case []interface{}:
+		if len(v) > 0 {
+			if _, ok := v[0].(map[interface{}]interface{}); ok {
+				for i, item := range v {
+					name := strconv.Itoa(i)
+					if dbname, ok := item.(map[interface{}]interface{})["DBName"]; ok {
+						name = fmt.Sprint(dbname)
+					}
+					collectFileKeys(item, prefix+name+".", keys)
+				}
+				return
+			}
+		}
+	}
+	keys[strings.ToLower(strings.TrimSuffix(prefix, "."))] = true
+}
+
+func (c *Config) applyEnv(origins map[string]string) ValidationErrors {
+	var errs ValidationErrors
+
+	known := make(map[string]bool)
+	for _, f := range configFields(c) {
+		name := envName(f.key)
+		known[name] = true
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFieldValue(f.value, value); err != nil {
+			errs.add(name, "invalid value %q for %s: %s", value, f.key, err.Error())
+			continue
+		}
+		origins[f.key] = OriginEnv
+	}
+
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, EnvPrefix) && !known[name] {
+			errs.add(name, "unknown config key")
+		}
+	}
+	return errs
+}
+
+func (c *Config) applySets(sets []string, origins map[string]string) ValidationErrors {
+	var errs ValidationErrors
+
+	fields := configFields(c)
+	for _, set := range sets {
+		kv := strings.SplitN(set, "=", 2)
+		if len(kv) != 2 {
+			errs.add("-set "+set, "want key=value")
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		found := false
+		for _, f := range fields {
+			if !strings.EqualFold(f.key, key) {
+				continue
+			}
+			found = true
+			if err := setFieldValue(f.value, kv[1]); err != nil {
+				errs.add("-set "+key, "invalid value %q: %s", kv[1], err.Error())
+				break
+			}
+			origins[f.key] = OriginFlag
+			break
+		}
+		if !found {
+			errs.add("-set "+key, "unknown config key")
+		}
+	}
+	return errs
+}
+
+func (c *Config) Origin(key string) string {
+	if origin, ok := c.origins[key]; ok {
+		return origin
+	}
+	return OriginDefault
+}
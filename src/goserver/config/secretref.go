@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+/*
+String values may hold secret references instead of the secret itself:
+
+	DataSourceName: root:${file:/run/secrets/mysql_pw}@tcp(db:3306)/eop
+	DataSourceName: root:${env:MYSQL_PW}@tcp(db:3306)/eop
+
+They are resolved on every load, so a reload picks up rotated secrets.
+A file reference drops the trailing newline of the file.
+Only fields tagged secret and the passwords of DSNs are masked by Redacted
+and RedactString, a reference elsewhere is shown resolved.
+*/
+var secretRefPattern = regexp.MustCompile(`\$\{(file|env):([^}]+)\}`)
+
+func resolveSecretRef(kind, name string) (string, error) {
+	switch kind {
+	case "file":
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	default:
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+}
+
+func (c *Config) resolveSecretRefs() ValidationErrors {
+	var errs ValidationErrors
+
+	resolve := func(key string, s string) string {
+		return secretRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+			m := secretRefPattern.FindStringSubmatch(ref)
+			value, err := resolveSecretRef(m[1], m[2])
+			if err != nil {
+				errs.add(key, "can't resolve %s: %s", ref, err.Error())
+				return ref
+			}
+			return value
+		})
+	}
+
+	for _, f := range configFields(c) {
+		switch {
+		case f.value.Kind() == reflect.String:
+			f.value.SetString(resolve(f.path, f.value.String()))
+		case f.value.Kind() == reflect.Slice && f.value.Type().Elem().Kind() == reflect.String:
+			for i := 0; i < f.value.Len(); i++ {
+				e := f.value.Index(i)
+				e.SetString(resolve(fmt.Sprintf("%s[%d]", f.path, i), e.String()))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+)
+
+/*
+ValidationError is one problem in a config, Path is the yaml path of
+the value, like dbserver.dbitems[1].MaxIdleConns.
+*/
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+var logLevels = []string{"trace", "debug", "info", "warn", "error", "critical", "off"}
+
+/*
+Validate returns every problem found in the config, or nil.
+DriverName is checked against the drivers registered with database/sql,
+so the driver packages have to be linked in (dbserver does that).
+*/
+func (c *Config) Validate() ValidationErrors {
+	var errs ValidationErrors
+
+	if !contains(logLevels, c.Logging.Level) {
+		errs.add("logging.level", "unknown level %q, want one of %s", c.Logging.Level, strings.Join(logLevels, ", "))
+	}
+	if c.Logging.Filename == "" {
+		errs.add("logging.filename", "is empty")
+	}
+	if c.Logging.Maxsize <= 0 {
+		errs.add("logging.maxsize", "must be greater than 0")
+	}
+	if c.Logging.Maxrolls < 0 {
+		errs.add("logging.maxrolls", "must not be negative")
+	}
+
+	validateSwitch(&errs, "daemon.switch", c.Daemon.Switch)
+
+	validateSwitch(&errs, "httpserver.switch", c.HttpServer.Switch)
+	if c.HttpServer.Switch == "on" {
+		validateListen(&errs, "httpserver", c.HttpServer.Ip, c.HttpServer.Port)
+		validateTLS(&errs, "httpserver", &c.HttpServer)
+	}
+
+	validateSwitch(&errs, "admin.switch", c.Admin.Switch)
+	validateSwitch(&errs, "admin.pprof", c.Admin.Pprof)
+	if c.Admin.Switch == "on" {
+		validateListen(&errs, "admin", c.Admin.Ip, c.Admin.Port)
+		if c.HttpServer.Switch == "on" && c.Admin.Port == c.HttpServer.Port && sameHost(c.Admin.Ip, c.HttpServer.Ip) {
+			errs.add("admin.port", "%d is already used by httpserver", c.Admin.Port)
+		}
+		if c.Admin.Token == "" && c.Admin.User == "" {
+			errs.add("admin.token", "is empty, set a token or a user and password")
+		}
+		if c.Admin.User != "" && c.Admin.Password == "" {
+			errs.add("admin.password", "is empty")
+		}
+	}
+
+	validateSwitch(&errs, "dbserver.switch", c.DBServer.Switch)
+	validateSwitch(&errs, "dbserver.log_sql_execute_time_switch", c.DBServer.LogSQLExecuteTimeSwitch)
+	if c.DBServer.ConnCheckInterval < 0 {
+		errs.add("dbserver.conn_check_interval", "must not be negative")
+	}
+	if c.DBServer.ConnCheckTimeout < 0 {
+		errs.add("dbserver.conn_check_timeout", "must not be negative")
+	}
+	if c.DBServer.ConnCheckMaxBackoff < c.DBServer.ConnCheckInterval {
+		errs.add("dbserver.conn_check_max_backoff", "must not be less than conn_check_interval(%d)", c.DBServer.ConnCheckInterval)
+	}
+
+	drivers := sql.Drivers()
+	dbnames := make(map[string]int)
+	for i, item := range c.DBServer.DBItems {
+		path := fmt.Sprintf("dbserver.dbitems[%d]", i)
+		if item.DBName == "" {
+			errs.add(path+".DBName", "is empty")
+		} else if j, ok := dbnames[item.DBName]; ok {
+			errs.add(path+".DBName", "%q is already used by dbserver.dbitems[%d]", item.DBName, j)
+		} else {
+			dbnames[item.DBName] = i
+		}
+		if !contains(drivers, item.DriverName) {
+			errs.add(path+".DriverName", "unknown driver %q, want one of %s", item.DriverName, strings.Join(drivers, ", "))
+		}
+		if item.DataSourceName == "" {
+			errs.add(path+".DataSourceName", "is empty")
+		}
+		for j, dsn := range item.FallbackDSNs {
+			if dsn == "" {
+				errs.add(fmt.Sprintf("%s.FallbackDSNs[%d]", path, j), "is empty")
+			}
+		}
+		if item.Required != "" {
+			validateSwitch(&errs, path+".Required", item.Required)
+		}
+		if item.Failback != "" {
+			validateSwitch(&errs, path+".Failback", item.Failback)
+		}
+		if item.FailbackAfter < 0 {
+			errs.add(path+".FailbackAfter", "must not be negative")
+		}
+		for j, dsn := range item.Replicas {
+			if dsn == "" {
+				errs.add(fmt.Sprintf("%s.Replicas[%d]", path, j), "is empty")
+			}
+		}
+		if item.ReplicaPolicy != "" && item.ReplicaPolicy != "round_robin" && item.ReplicaPolicy != "least_conn" {
+			errs.add(path+".ReplicaPolicy", "%q is not round_robin or least_conn", item.ReplicaPolicy)
+		}
+		if item.MaxIdleConns < 0 {
+			errs.add(path+".MaxIdleConns", "must not be negative")
+		}
+		if item.MaxOpenConns < 0 {
+			errs.add(path+".MaxOpenConns", "must not be negative")
+		}
+		if item.StatementTimeout < 0 {
+			errs.add(path+".StatementTimeout", "must not be negative")
+		}
+		if item.StmtCacheSize < 0 {
+			errs.add(path+".StmtCacheSize", "must not be negative")
+		}
+		if item.SlowThreshold < 0 {
+			errs.add(path+".SlowThreshold", "must not be negative")
+		}
+		if item.FastSampleRate < 0 || item.FastSampleRate > 1 {
+			errs.add(path+".FastSampleRate", "%v is not between 0 and 1", item.FastSampleRate)
+		}
+		if item.MaxOpenConns > 0 && item.MaxIdleConns > item.MaxOpenConns {
+			errs.add(path+".MaxIdleConns", "%d is greater than MaxOpenConns %d", item.MaxIdleConns, item.MaxOpenConns)
+		}
+	}
+
+	if c.Shutdown.Delay < 0 {
+		errs.add("shutdown.delay", "must not be negative")
+	}
+	if c.Shutdown.Timeout <= 0 {
+		errs.add("shutdown.timeout", "must be greater than 0")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validateSwitch(errs *ValidationErrors, path string, value string) {
+	if value != "on" && value != "off" {
+		errs.add(path, "%q is not on or off", value)
+	}
+}
+
+func validateListen(errs *ValidationErrors, section string, ip string, port uint16) {
+	if ip != "" && net.ParseIP(ip) == nil {
+		errs.add(section+".ip", "%q is not an ip address", ip)
+	}
+	if port == 0 {
+		errs.add(section+".port", "must not be 0")
+	}
+}
+
+var tlsVersions = []string{"1.0", "1.1", "1.2", "1.3"}
+var cipherPolicies = []string{"default", "intermediate"}
+var clientAuthModes = []string{"none", "request", "require", "verify_if_given", "require_and_verify"}
+
+func validateTLS(errs *ValidationErrors, section string, c *HttpServerConfig) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs.add(section+".key_file", "cert_file and key_file must be set together")
+	}
+	if !contains(tlsVersions, c.MinTLSVersion) {
+		errs.add(section+".min_tls_version", "%q is not one of %s", c.MinTLSVersion, strings.Join(tlsVersions, ", "))
+	}
+	if !contains(cipherPolicies, c.Ciphers) {
+		errs.add(section+".ciphers", "%q is not one of %s", c.Ciphers, strings.Join(cipherPolicies, ", "))
+	}
+	if c.ClientAuth != "" && !contains(clientAuthModes, c.ClientAuth) {
+		errs.add(section+".client_auth", "%q is not one of %s", c.ClientAuth, strings.Join(clientAuthModes, ", "))
+	}
+	if c.ClientCAFile != "" && c.CertFile == "" {
+		errs.add(section+".client_ca_file", "needs cert_file")
+	}
+	if (c.ClientAuth == "verify_if_given" || c.ClientAuth == "require_and_verify") && c.ClientCAFile == "" {
+		errs.add(section+".client_auth", "%s needs client_ca_file", c.ClientAuth)
+	}
+}
+
+/*
+sameHost is true when listening on a and b would collide, an empty or
+unspecified ip listens on every address.
+*/
+func sameHost(a, b string) bool {
+	ipa, ipb := net.ParseIP(a), net.ParseIP(b)
+	if ipa == nil || ipb == nil || ipa.IsUnspecified() || ipb.IsUnspecified() {
+		return true
+	}
+	return ipa.Equal(ipb)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,31 +1,61 @@
 package dbserver
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/mattn/go-sqlite3"
+	"sync"
 	"time"
 
 	"goserver/config"
 	"goserver/log"
 )
 
+/*
+The exported fields of a DBItem don't change once it is registered,
+a new config replaces the whole item.
+Reads go to Replicas when there are some, writes always to the primary
+DataSourceName, see acquireRead.
+*/
 type DBItem struct {
-	DriverName     string
-	DataSourceName string
-	MaxIdleConns   int
-	MaxOpenConns   int
-	Connected      int //1:connected, 0:notconnected
-	DB             *sql.DB
+	DriverName       string
+	Required         string //off:not waited for by readiness
+	DataSourceName   string
+	FallbackDSNs     []string //tried in order when DataSourceName is down
+	Failback         string   //on:go back to DataSourceName once it is up for FailbackAfter
+	FailbackAfter    time.Duration
+	Replicas         []string
+	ReplicaPolicy    string //round_robin, least_conn
+	MaxIdleConns     int
+	MaxOpenConns     int
+	StatementTimeout time.Duration  //0:no timeout
+	StmtCacheSize    int            //0:no statement cache
+	SlowThreshold    time.Duration  //0:no slow query log
+	FastSampleRate   float64        //share of the faster queries also logged, 0~1
+	location         *time.Location //of times without zone, the loc of the DSN
+	primary          *endpoint
+	replicas         []*endpoint
+	next             uint32 //round robin position
 }
 
+/*
+Database is safe for concurrent use, items may be added, replaced and
+removed while queries run. lock also guards the settings below,
+a reload changes them.
+*/
 type Database struct {
-	DBItems                 map[string]*DBItem
-	LogSQLExecuteTimeSwitch string
+	lock                    sync.RWMutex
+	items                   map[string]*DBItem
+	logSQLExecuteTimeSwitch string
+	checkInterval           time.Duration
+	checkTimeout            time.Duration
+	maxBackoff              time.Duration
 }
 
 var database *Database
+var connCheckStop chan struct{}
 
 func Run(c *config.Config) {
 	if c.DBServer.Switch != "on" {
@@ -33,222 +63,316 @@ func Run(c *config.Config) {
 	}
 
 	if database == nil {
-		database = &Database{
-			DBItems:                 make(map[string]*DBItem),
-			LogSQLExecuteTimeSwitch: c.DBServer.LogSQLExecuteTimeSwitch,
-		}
+		database = newDatabase()
 	}
+	database.setOptions(c)
 
 	for i := 0; i < len(c.DBServer.DBItems); i++ {
-		database.AddItem(
-			c.DBServer.DBItems[i].DBName,
-			c.DBServer.DBItems[i].DriverName,
-			c.DBServer.DBItems[i].DataSourceName,
-			c.DBServer.DBItems[i].MaxIdleConns,
-			c.DBServer.DBItems[i].MaxOpenConns)
+		database.addItemFromConfig(c.DBServer.DBItems[i])
 	}
 	database.Connect()
 
-	if c.DBServer.ConnCheckInterval > 0 {
-		go func() {
-			timer := time.NewTimer(time.Second * 5)
-			for {
-				select {
-				case <-timer.C:
-					database.Connect()
-					timer.Reset(time.Second * 5)
-				}
+	if interval := time.Duration(c.DBServer.ConnCheckInterval) * time.Second; interval > 0 {
+		startConnCheck(interval)
+	}
+}
+
+/*
+Reload applies the dbserver part of a config diff: removed items are
+closed, changed items are replaced by a new connection, new items are
+connected. Replaced and removed dbs are closed once their queries finish.
+Switching dbserver off removes every item, so readiness doesn't wait for
+them; switching it on again adds them back.
+*/
+func Reload(c *config.Config, d *config.ConfigDiff) {
+	if c.DBServer.Switch != "on" {
+		stopConnCheck()
+		if database != nil {
+			for dbname := range database.snapshot() {
+				database.DelItem(dbname)
+				log.Infof("db(%s) removed, dbserver off", dbname)
 			}
-		}()
+		}
+		return
 	}
+
+	db := GetDatabase()
+	db.setOptions(c)
+
+	for _, item := range d.DBItemsRemoved {
+		db.DelItem(item.DBName)
+		log.Infof("db(%s) removed", item.DBName)
+	}
+	for _, item := range d.DBItemsChanged {
+		db.replaceItem(item.DBName, newItemFromConfig(item))
+		log.Infof("db(%s) changed, reconnected", item.DBName)
+	}
+
+	if d.DBServer {
+		stopConnCheck()
+		Run(c)
+		return
+	}
+
+	for _, item := range d.DBItemsAdded {
+		db.addItemFromConfig(item)
+		log.Infof("db(%s) added", item.DBName)
+	}
+	db.Connect()
 }
 
-func GetDatabase() *Database {
+/*
+Shutdown stops the connection check and closes every db
+once the queries using it are done.
+*/
+func Shutdown(ctx context.Context) error {
 	if database == nil {
-		database = &Database{
-			DBItems: make(map[string]*DBItem),
+		return nil
+	}
+
+	stopConnCheck()
+
+	done := make(chan struct{})
+	go func() {
+		database.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func startConnCheck(interval time.Duration) {
+	connCheckStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		timer := time.NewTimer(interval)
+		for {
+			select {
+			case <-timer.C:
+				database.CheckHealth()
+				timer.Reset(interval)
+			case <-stop:
+				timer.Stop()
+				return
+			}
 		}
+	}(connCheckStop)
+}
+
+func stopConnCheck() {
+	if connCheckStop != nil {
+		close(connCheckStop)
+		connCheckStop = nil
+	}
+}
+
+func (database *Database) setOptions(c *config.Config) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	database.logSQLExecuteTimeSwitch = c.DBServer.LogSQLExecuteTimeSwitch
+	database.checkInterval = time.Duration(c.DBServer.ConnCheckInterval) * time.Second
+	database.checkTimeout = time.Duration(c.DBServer.ConnCheckTimeout) * time.Second
+	database.maxBackoff = time.Duration(c.DBServer.ConnCheckMaxBackoff) * time.Second
+}
+
+func (database *Database) logSQLExecuteTime() bool {
+	database.lock.RLock()
+	defer database.lock.RUnlock()
+	return database.logSQLExecuteTimeSwitch == "on"
+}
+
+func (database *Database) checkTimes() (interval, timeout, maxBackoff time.Duration) {
+	database.lock.RLock()
+	defer database.lock.RUnlock()
+	return database.checkInterval, database.checkTimeout, database.maxBackoff
+}
+
+func newDatabase() *Database {
+	return &Database{
+		items: make(map[string]*DBItem),
+	}
+}
+
+func GetDatabase() *Database {
+	if database == nil {
+		database = newDatabase()
 	}
 	return database
 }
 
 func Status() string {
-	status := "DBName\tDriver\tMaxIdleConns\tMaxOpenConns\tConnected\tOpenConnections\n"
-	for dbname, dbinfo := range database.DBItems {
-		openConnections := 0
-		db := database.DBItems[dbname].DB
-		if db != nil {
-			dbstats := db.Stats()
-			openConnections = dbstats.OpenConnections
-		}
-		status = status + fmt.Sprintf("%s\t%s\t%d\t%d\t%d\t%d\n", dbname, dbinfo.DriverName, dbinfo.MaxIdleConns, dbinfo.MaxOpenConns, dbinfo.Connected, openConnections)
+	status := "DBName\tRole\tDriver\tMaxIdleConns\tMaxOpenConns\tConnected\tOpenConnections\tInUse\tIdle\tWaitCount\tWaitDuration\tActiveDSN\tFailovers\tStmtCache\tState\tLastSuccess\tLastError\n"
+	for _, s := range Statuses() {
+		status = status + fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%v\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			s.DBName, s.Role, s.DriverName, s.MaxIdleConns, s.MaxOpenConns, s.Connected, s.OpenConnections,
+			s.DBStats.InUse, s.DBStats.Idle, s.DBStats.WaitCount, s.DBStats.WaitDuration,
+			s.ActiveDSN, s.Failovers, formatStmtCache(s),
+			s.State, formatTime(s.LastSuccess), formatLastError(s))
 	}
 	return status
 }
 
-func (database *Database) AddItem(itemName string, driverName string, dataSourceName string, maxIdleConns int, maxOpenConns int) {
-	if database.DBItems[itemName] != nil {
-		if database.DBItems[itemName].Connected == 1 {
-			return
-		}
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
 	}
-	var item DBItem
-	item.DriverName = driverName
-	item.DataSourceName = dataSourceName
-	item.MaxIdleConns = maxIdleConns
-	item.MaxOpenConns = maxOpenConns
-	item.Connected = 0
-	item.DB = nil
-	database.DBItems[itemName] = &item
-}
-
-func (database *Database) DelItem(itemName string) {
-	delete(database.DBItems, itemName)
+	return t.Format("2006-01-02 15:04:05")
 }
 
-func (database *Database) Connect() {
-	for _, v := range database.DBItems {
-		if v.Connected == 0 || v.DB == nil {
-			db, err := sql.Open(v.DriverName, v.DataSourceName)
-			if err != nil {
-				continue
-			}
-			v.DB = db
-			v.DB.SetMaxOpenConns(v.MaxOpenConns)
-			v.DB.SetMaxIdleConns(v.MaxIdleConns)
-			err = v.DB.Ping()
-			if err != nil {
-				v.DB = nil
-			} else {
-				v.Connected = 1
-			}
-		}
+func formatStmtCache(s ItemStatus) string {
+	if s.StmtCacheSize == 0 {
+		return "-"
 	}
+	return fmt.Sprintf("%d/%d hits:%d misses:%d", s.StmtCacheLen, s.StmtCacheSize, s.StmtCacheHits, s.StmtCacheMisses)
 }
 
-func (database *Database) GetDB(itemname string) *sql.DB {
-	if database.DBItems[itemname] == nil {
-		return nil
+func formatLastError(s ItemStatus) string {
+	if s.LastError == "" {
+		return "-"
 	}
-	return database.DBItems[itemname].DB
+	return formatTime(s.LastErrorTime) + " " + s.LastError
 }
 
 /*
-You should remember to close sql.Rows
+AddItem keeps a connected item of the same name, an item that is not
+connected is replaced.
 */
-func (database *Database) Query(dbname, sqlstr string) (*sql.Rows, error) {
-	if database.DBItems[dbname] == nil {
-		return nil, fmt.Errorf("db(%s) not found", dbname)
-	}
-
-	db := database.DBItems[dbname].DB
+func (database *Database) AddItem(itemName string, driverName string, dataSourceName string, maxIdleConns int, maxOpenConns int) {
+	database.addItem(itemName, newItem(itemName, driverName, dataSourceName, maxIdleConns, maxOpenConns))
+}
 
-	if db == nil {
-		database.DBItems[dbname].Connected = 0
-		return nil, fmt.Errorf("db(%s) not connected", dbname)
+func (database *Database) addItem(itemName string, item *DBItem) {
+	database.lock.Lock()
+	old := database.items[itemName]
+	if old != nil && old.connected() {
+		database.lock.Unlock()
+		return
 	}
+	database.items[itemName] = item
+	database.lock.Unlock()
 
-	begintime := time.Now()
-	rows, err := db.Query(sqlstr)
-	if database.LogSQLExecuteTimeSwitch == "on" {
-		log.Infof("Query(%s), time:%v", sqlstr, time.Now().Sub(begintime))
+	if old != nil {
+		old.retire()
 	}
-
-	return rows, err
 }
 
 /*
-This function is for small results
+ReplaceItem connects a new item and then swaps it in, queries running on
+the old one finish before its db is closed.
 */
-func (database *Database) QueryData(dbname, sqlstr string) (int, *[]map[string]interface{}, error) {
-	if database.DBItems[dbname] == nil {
-		return -1, nil, fmt.Errorf("db(%s) not found", dbname)
-	}
+func (database *Database) ReplaceItem(itemName string, driverName string, dataSourceName string, maxIdleConns int, maxOpenConns int) {
+	database.replaceItem(itemName, newItem(itemName, driverName, dataSourceName, maxIdleConns, maxOpenConns))
+}
 
-	db := database.DBItems[dbname].DB
+func (database *Database) replaceItem(itemName string, item *DBItem) {
+	database.connectItem(item)
+	database.putItem(itemName, item)
+}
 
-	if db == nil {
-		database.DBItems[dbname].Connected = 0
-		return -1, nil, fmt.Errorf("db(%s) not connected", dbname)
+func newItem(itemName string, driverName string, dataSourceName string, maxIdleConns int, maxOpenConns int) *DBItem {
+	return &DBItem{
+		DriverName:     driverName,
+		DataSourceName: dataSourceName,
+		ReplicaPolicy:  PolicyRoundRobin,
+		MaxIdleConns:   maxIdleConns,
+		MaxOpenConns:   maxOpenConns,
+		location:       dsnLocation(driverName, dataSourceName),
+		primary:        &endpoint{name: itemName, role: "primary", dsns: []string{dataSourceName}},
 	}
+}
 
-	begintime := time.Now()
-	rows, err := db.Query(sqlstr)
-	if err != nil {
-		return -1, nil, err
+func newItemFromConfig(c config.DBItemConfig) *DBItem {
+	item := newItem(c.DBName, c.DriverName, c.DataSourceName, c.MaxIdleConns, c.MaxOpenConns)
+	item.StatementTimeout = time.Duration(c.StatementTimeout) * time.Second
+	item.Required = c.Required
+	item.StmtCacheSize = c.StmtCacheSize
+	item.SlowThreshold = time.Duration(c.SlowThreshold) * time.Millisecond
+	item.FastSampleRate = c.FastSampleRate
+	if c.ReplicaPolicy != "" {
+		item.ReplicaPolicy = c.ReplicaPolicy
 	}
-	defer rows.Close()
-
-	if database.LogSQLExecuteTimeSwitch == "on" {
-		log.Infof("QueryData(%s), time:%v", sqlstr, time.Now().Sub(begintime))
+	item.FallbackDSNs = c.FallbackDSNs
+	item.Failback = c.Failback
+	item.FailbackAfter = time.Duration(c.FailbackAfter) * time.Second
+	item.primary.dsns = append(item.primary.dsns, c.FallbackDSNs...)
+	item.Replicas = c.Replicas
+	for i, dsn := range c.Replicas {
+		role := fmt.Sprintf("replica%d", i)
+		item.replicas = append(item.replicas, &endpoint{name: c.DBName + "/" + role, role: role, dsns: []string{dsn}})
 	}
+	return item
+}
+
+func (database *Database) addItemFromConfig(c config.DBItemConfig) {
+	database.addItem(c.DBName, newItemFromConfig(c))
+}
 
-	columns, _ := rows.Columns()
-	scanArgs := make([]interface{}, len(columns))
-	values := make([]interface{}, len(columns))
-	for i := range values {
-		scanArgs[i] = &values[i]
+/*
+DelItem unregisters the item at once, its db is closed once the queries
+still using it are done.
+*/
+func (database *Database) DelItem(itemName string) {
+	database.lock.Lock()
+	item := database.items[itemName]
+	delete(database.items, itemName)
+	database.lock.Unlock()
+
+	if item != nil {
+		item.retire()
 	}
+}
 
-	records := make([]map[string]interface{}, 0)
-	for rows.Next() {
-		record := make(map[string]interface{})
-		err := rows.Scan(scanArgs...)
-		if err != nil {
-			continue
-		}
-		for i, col := range values {
-			if col != nil {
-				record[columns[i]] = col
-			} else {
-				record[columns[i]] = nil
+/*
+Connect opens every server that has no db yet, ignoring the backoff.
+*/
+func (database *Database) Connect() {
+	for _, item := range database.snapshot() {
+		for _, ep := range item.endpoints() {
+			if !ep.connected() {
+				database.connectEndpoint(item, ep)
 			}
 		}
-		records = append(records, record)
 	}
+}
 
-	/*
-		for row := range records {
-			for k, v := range records[row] {
-				println(k, ":", v)
+/*
+Close disconnects every item and waits for their queries to finish
+before closing the dbs.
+*/
+func (database *Database) Close() {
+	var wg sync.WaitGroup
+	for _, item := range database.snapshot() {
+		for _, ep := range item.endpoints() {
+			if old := ep.detach(); old != nil {
+				wg.Add(1)
+				go func(name string, h *dbHandle) {
+					defer wg.Done()
+					h.close(name)
+				}(ep.name, old)
 			}
+			ep.health.close()
 		}
-	*/
-	return len(records), &records, nil
-}
-
-func (database *Database) Exec(dbname, sqlstr string, args ...interface{}) (int64, int64, error) {
-	if database.DBItems[dbname] == nil {
-		return -1, -1, fmt.Errorf("db(%s) not found", dbname)
-	}
-
-	db := database.DBItems[dbname].DB
-
-	if db == nil {
-		database.DBItems[dbname].Connected = 0
-		fmt.Println(dbname + " not connected")
-		return -1, -1, fmt.Errorf("db(%s) not connected", dbname)
-	}
-
-	begintime := time.Now()
-
-	stmt, err := db.Prepare(sqlstr)
-	if err != nil {
-		return -1, -1, fmt.Errorf("db(%s) prepare error:%s", dbname, err.Error())
 	}
-	defer stmt.Close()
+	wg.Wait()
+}
 
-	res, err := stmt.Exec(args...)
-	if err != nil {
-		return -1, -1, fmt.Errorf("db(%s) exec error:%s", dbname, err.Error())
+/*
+GetDB returns the current primary db of an item, or nil. It is not
+protected from a reconnect closing it, use the query helpers where possible.
+*/
+func (database *Database) GetDB(itemname string) *sql.DB {
+	item := database.item(itemname)
+	if item == nil {
+		return nil
 	}
-
-	if database.LogSQLExecuteTimeSwitch == "on" {
-		log.Infof("Exec(%s), time:%v", sqlstr, time.Now().Sub(begintime))
+	item.primary.lock.Lock()
+	defer item.primary.lock.Unlock()
+	if item.primary.handle == nil {
+		return nil
 	}
-
-	affectCnt, _ := res.RowsAffected()
-	lastId, _ := res.LastInsertId()
-
-	return lastId, affectCnt, nil
+	return item.primary.handle.db
 }
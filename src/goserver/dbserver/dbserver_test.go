@@ -0,0 +1,111 @@
+package dbserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"goserver/config"
+)
+
+var testDBCount = 0
+
+/*
+newTestDatabase returns a Database with one connected in-memory SQLite
+item named "test" and a table t(id integer, name text).
+*/
+func newTestDatabase(t *testing.T) *Database {
+	testDBCount++
+	d := newDatabase()
+	d.AddItem("test", "sqlite3", fmt.Sprintf("file:test%d?mode=memory&cache=shared", testDBCount), 4, 4)
+	d.Connect()
+	if d.GetDB("test") == nil {
+		t.Fatal("Can't connect to the test database")
+	}
+	if _, _, err := d.Exec("test", "create table t(id integer, name text)"); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestQueryDataStrict(t *testing.T) {
+	d := newTestDatabase(t)
+	d.Exec("test", "insert into t values(1, 'a'), ('x', 'b'), (3, 'c')")
+
+	_, _, err := d.QueryData("test", "select * from t order by name")
+	scanError, ok := err.(*ScanError)
+	if !ok {
+		t.Fatalf("Unexpected QueryData error. Found %v, expected a *ScanError", err)
+	}
+	if scanError.Row != 1 || scanError.Column != "id" {
+		t.Fatalf("Unexpected ScanError. Found row %d column %s, expected row 1 column id", scanError.Row, scanError.Column)
+	}
+}
+
+func TestQueryDataLenient(t *testing.T) {
+	d := newTestDatabase(t)
+	d.Exec("test", "insert into t values(1, 'a'), ('x', 'b'), (3, 'c')")
+
+	count, records, scanErrors, err := d.QueryDataLenient("test", "select * from t order by name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || len(*records) != 2 || (*records)[1]["id"] != int64(3) {
+		t.Fatalf("Unexpected records: %v", *records)
+	}
+	if len(scanErrors) != 1 || scanErrors[0].Row != 1 {
+		t.Fatalf("Unexpected scan errors: %v", scanErrors)
+	}
+}
+
+func TestSetOptionsWhileQuerying(t *testing.T) {
+	d := newTestDatabase(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c := config.DefaultConfig()
+		for i := 0; i < 100; i++ {
+			c.DBServer.LogSQLExecuteTimeSwitch = []string{"on", "off"}[i%2]
+			c.DBServer.ConnCheckTimeout = i
+			d.setOptions(c)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		d.Exec("test", "insert into t values(1, 'a')")
+		d.backoff(2)
+	}
+	<-done
+	if _, timeout, _ := d.checkTimes(); timeout != 99*time.Second {
+		t.Fatalf("Unexpected check timeout. Found %v, expected 99s", timeout)
+	}
+}
+
+func TestReloadSwitchOffOn(t *testing.T) {
+	on := config.DefaultConfig()
+	on.DBServer.DBItems = []config.DBItemConfig{
+		{DBName: "switch", DriverName: "sqlite3", DataSourceName: "file:switch?mode=memory&cache=shared", MaxOpenConns: 1},
+	}
+	off := *on
+	off.DBServer.Switch = "off"
+	Run(on)
+	defer GetDatabase().DelItem("switch")
+
+	assertItems := func(n int) {
+		statuses := Statuses()
+		if len(statuses) != n {
+			t.Fatalf("Unexpected dbitems. Found %+v, expected %d", statuses, n)
+		}
+		for _, s := range statuses {
+			if s.Connected != 1 {
+				t.Fatalf("Unexpected dbitem not connected: %+v", s)
+			}
+		}
+	}
+	assertItems(1)
+
+	Reload(&off, config.Diff(on, &off))
+	assertItems(0)
+
+	Reload(on, config.Diff(&off, on))
+	assertItems(1)
+}
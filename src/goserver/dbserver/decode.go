@@ -0,0 +1,500 @@
+package dbserver
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"goserver/config"
+)
+
+/*
+Drivers hand back values in different shapes, MySQL's text protocol gives
+[]byte for everything while its binary protocol (queries with args) and
+SQLite give native types. The decoder uses the column types to turn both
+into int64, float64, bool, time.Time, string, []byte or nil.
+DECIMAL stays a string so no precision is lost, MySQL TIME is a string too.
+*/
+type columnKind int
+
+const (
+	kindRaw columnKind = iota
+	kindInt
+	kindFloat
+	kindBool
+	kindTime
+	kindString
+	kindBytes
+)
+
+var mysqlKinds = map[string]columnKind{
+	"TINYINT":    kindInt,
+	"SMALLINT":   kindInt,
+	"MEDIUMINT":  kindInt,
+	"INT":        kindInt,
+	"INTEGER":    kindInt,
+	"BIGINT":     kindInt,
+	"YEAR":       kindInt,
+	"FLOAT":      kindFloat,
+	"DOUBLE":     kindFloat,
+	"REAL":       kindFloat,
+	"BOOL":       kindBool,
+	"BOOLEAN":    kindBool,
+	"DATE":       kindTime,
+	"DATETIME":   kindTime,
+	"TIMESTAMP":  kindTime,
+	"DECIMAL":    kindString,
+	"TIME":       kindString,
+	"CHAR":       kindString,
+	"VARCHAR":    kindString,
+	"TINYTEXT":   kindString,
+	"TEXT":       kindString,
+	"MEDIUMTEXT": kindString,
+	"LONGTEXT":   kindString,
+	"ENUM":       kindString,
+	"SET":        kindString,
+	"JSON":       kindString,
+	"BINARY":     kindBytes,
+	"VARBINARY":  kindBytes,
+	"TINYBLOB":   kindBytes,
+	"BLOB":       kindBytes,
+	"MEDIUMBLOB": kindBytes,
+	"LONGBLOB":   kindBytes,
+	"BIT":        kindBytes,
+	"GEOMETRY":   kindBytes,
+}
+
+/*
+SQLite columns can be declared with any type name,
+so follow its type affinity rules instead of a fixed list.
+*/
+func sqliteKind(typeName string) columnKind {
+	switch {
+	case typeName == "":
+		return kindRaw
+	case strings.Contains(typeName, "BOOL"):
+		return kindBool
+	case strings.Contains(typeName, "DATE") || strings.Contains(typeName, "TIME"):
+		return kindTime
+	case strings.Contains(typeName, "INT"):
+		return kindInt
+	case strings.Contains(typeName, "CHAR") || strings.Contains(typeName, "CLOB") || strings.Contains(typeName, "TEXT"):
+		return kindString
+	case strings.Contains(typeName, "BLOB"):
+		return kindBytes
+	case strings.Contains(typeName, "REAL") || strings.Contains(typeName, "FLOA") || strings.Contains(typeName, "DOUB"):
+		return kindFloat
+	}
+	return kindRaw
+}
+
+func columnKindOf(driverName, typeName string) columnKind {
+	typeName = strings.ToUpper(strings.TrimSpace(typeName))
+	if i := strings.Index(typeName, "("); i >= 0 {
+		typeName = strings.TrimSpace(typeName[:i])
+	}
+	typeName = strings.TrimSpace(strings.Replace(typeName, "UNSIGNED", "", -1))
+
+	switch driverName {
+	case "sqlite3":
+		return sqliteKind(typeName)
+	default:
+		return mysqlKinds[typeName]
+	}
+}
+
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02",
+}
+
+/*
+parseTime reads a time without zone in loc, the location the DSN asks
+the driver for.
+*/
+func parseTime(s string, loc *time.Location) (time.Time, error) {
+	if strings.HasPrefix(s, "0000-00-00") {
+		return time.Time{}, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse %q as time", s)
+}
+
+/*
+dsnLocation is the loc parameter of a MySQL DSN or the _loc of a SQLite
+one, UTC when it is missing or unknown like the drivers default to.
+*/
+func dsnLocation(driverName, dsn string) *time.Location {
+	param := "loc"
+	if driverName == "sqlite3" {
+		param = "_loc"
+	}
+	q := strings.Index(dsn, "?")
+	if q < 0 {
+		return time.UTC
+	}
+	values, err := url.ParseQuery(dsn[q+1:])
+	if err != nil {
+		return time.UTC
+	}
+	switch name := values.Get(param); name {
+	case "":
+		return time.UTC
+	case "Local", "auto":
+		return time.Local
+	default:
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+		return time.UTC
+	}
+}
+
+func convertValue(kind columnKind, v interface{}, loc *time.Location) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	s, isText := "", false
+	switch x := v.(type) {
+	case []byte:
+		s, isText = string(x), true
+	case string:
+		s, isText = x, true
+	}
+
+	switch kind {
+	case kindInt:
+		if isText {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return n, nil
+			}
+			return strconv.ParseUint(s, 10, 64)
+		}
+		switch x := v.(type) {
+		case bool:
+			if x {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case float64:
+			return int64(x), nil
+		}
+	case kindFloat:
+		if isText {
+			return strconv.ParseFloat(s, 64)
+		}
+		switch x := v.(type) {
+		case float32:
+			return float64(x), nil
+		case int64:
+			return float64(x), nil
+		}
+	case kindBool:
+		if isText {
+			return strconv.ParseBool(s)
+		}
+		if x, ok := v.(int64); ok {
+			return x != 0, nil
+		}
+	case kindTime:
+		if isText {
+			return parseTime(s, loc)
+		}
+		if x, ok := v.(int64); ok {
+			return time.Unix(x, 0).UTC(), nil
+		}
+	case kindString:
+		if isText {
+			return s, nil
+		}
+		return fmt.Sprint(v), nil
+	case kindBytes:
+		if x, ok := v.(string); ok {
+			return []byte(x), nil
+		}
+	default:
+		if x, ok := v.([]byte); ok {
+			return string(x), nil
+		}
+	}
+	return v, nil
+}
+
+/*
+ScanError is a row of a result that could not be scanned or decoded.
+Row is the 0 based index of the row, Column is empty when the error is not
+about one column, like a failed rows.Next.
+*/
+type ScanError struct {
+	DBName string
+	Row    int
+	Column string
+	Err    error
+}
+
+func (e *ScanError) Error() string {
+	if e.Column == "" {
+		return fmt.Sprintf("db(%s) scan row(%d) error:%s", e.DBName, e.Row, config.RedactString(e.Err.Error()))
+	}
+	return fmt.Sprintf("db(%s) scan row(%d) column(%s) error:%s", e.DBName, e.Row, e.Column, config.RedactString(e.Err.Error()))
+}
+
+type decodeError struct {
+	column string
+	err    error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("decode column(%s) error:%s", e.column, e.err.Error())
+}
+
+func newScanError(dbname string, row int, err error) *ScanError {
+	if de, ok := err.(*decodeError); ok {
+		return &ScanError{DBName: dbname, Row: row, Column: de.column, Err: de.err}
+	}
+	return &ScanError{DBName: dbname, Row: row, Err: err}
+}
+
+type rowDecoder struct {
+	loc      *time.Location
+	columns  []string
+	kinds    []columnKind
+	values   []interface{}
+	scanArgs []interface{}
+}
+
+func newRowDecoder(driverName string, loc *time.Location, rows *sql.Rows) (*rowDecoder, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &rowDecoder{
+		loc:      loc,
+		columns:  make([]string, len(columnTypes)),
+		kinds:    make([]columnKind, len(columnTypes)),
+		values:   make([]interface{}, len(columnTypes)),
+		scanArgs: make([]interface{}, len(columnTypes)),
+	}
+	typeNames := make([]string, len(columnTypes))
+	for i, ct := range columnTypes {
+		typeNames[i] = ct.DatabaseTypeName()
+		d.columns[i] = ct.Name()
+		d.kinds[i] = columnKindOf(driverName, typeNames[i])
+		d.scanArgs[i] = &d.values[i]
+	}
+	if err := checkTypeNames(driverName, typeNames); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+/*
+checkTypeNames refuses a MySQL result without any column type name:
+go-sql-driver/mysql before 1.3 doesn't report them, and every column
+would come back as a string. SQLite leaves expressions untyped, that is
+handled by its affinity rules.
+*/
+func checkTypeNames(driverName string, typeNames []string) error {
+	if driverName != "mysql" || len(typeNames) == 0 {
+		return nil
+	}
+	for _, typeName := range typeNames {
+		if typeName != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("driver %s reports no column types, go-sql-driver/mysql 1.3 or later is needed", driverName)
+}
+
+func (d *rowDecoder) scan(rows *sql.Rows) error {
+	return rows.Scan(d.scanArgs...)
+}
+
+/*
+value returns column i of the row last scanned, converted to its Go type.
+*/
+func (d *rowDecoder) value(i int) (interface{}, error) {
+	v, err := convertValue(d.kinds[i], d.values[i], d.loc)
+	if err != nil {
+		return nil, &decodeError{column: d.columns[i], err: err}
+	}
+	return v, nil
+}
+
+func (d *rowDecoder) record() (map[string]interface{}, error) {
+	record := make(map[string]interface{}, len(d.columns))
+	for i, col := range d.columns {
+		v, err := d.value(i)
+		if err != nil {
+			return nil, err
+		}
+		record[col] = v
+	}
+	return record, nil
+}
+
+/*
+structDecoder maps columns to the fields of a struct, by the db tag
+or else by the field name ignoring case. db:"-" skips a field.
+*/
+type structDecoder struct {
+	slice    reflect.Value
+	elemType reflect.Type
+	isPtr    bool
+	fields   []int //column -> field index, -1 for no field
+}
+
+func newStructDecoder(dest interface{}, columns []string) (*structDecoder, error) {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("dest must be a pointer to a slice of struct, not %T", dest)
+	}
+
+	sd := &structDecoder{slice: v.Elem(), elemType: v.Elem().Type().Elem()}
+	if sd.elemType.Kind() == reflect.Ptr {
+		sd.isPtr = true
+		sd.elemType = sd.elemType.Elem()
+	}
+	if sd.elemType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("dest must be a pointer to a slice of struct, not %T", dest)
+	}
+
+	byName := make(map[string]int)
+	for i := 0; i < sd.elemType.NumField(); i++ {
+		f := sd.elemType.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Tag.Get("db")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		byName[strings.ToLower(name)] = i
+	}
+
+	sd.fields = make([]int, len(columns))
+	for i, col := range columns {
+		sd.fields[i] = -1
+		if fi, ok := byName[strings.ToLower(col)]; ok {
+			sd.fields[i] = fi
+		}
+	}
+	return sd, nil
+}
+
+func (sd *structDecoder) appendRow(d *rowDecoder) error {
+	elem := reflect.New(sd.elemType)
+	for i, fi := range sd.fields {
+		if fi < 0 {
+			continue
+		}
+		v, err := d.value(i)
+		if err != nil {
+			return err
+		}
+		if err := setField(elem.Elem().Field(fi), v); err != nil {
+			return &decodeError{column: d.columns[i], err: err}
+		}
+	}
+	if sd.isPtr {
+		sd.slice.Set(reflect.Append(sd.slice, elem))
+	} else {
+		sd.slice.Set(reflect.Append(sd.slice, elem.Elem()))
+	}
+	return nil
+}
+
+func setField(f reflect.Value, v interface{}) error {
+	if scanner, ok := f.Addr().Interface().(sql.Scanner); ok {
+		return scanner.Scan(v)
+	}
+	if v == nil {
+		f.Set(reflect.Zero(f.Type()))
+		return nil
+	}
+	if f.Kind() == reflect.Ptr {
+		p := reflect.New(f.Type().Elem())
+		if err := setField(p.Elem(), v); err != nil {
+			return err
+		}
+		f.Set(p)
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Type().AssignableTo(f.Type()) {
+		f.Set(rv)
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		if t, ok := v.(time.Time); ok {
+			f.SetString(t.Format(time.RFC3339Nano))
+		} else if b, ok := v.([]byte); ok {
+			f.SetString(string(b))
+		} else {
+			f.SetString(fmt.Sprint(v))
+		}
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		switch rv.Kind() {
+		case reflect.Int64, reflect.Uint64, reflect.Float64:
+			f.Set(rv.Convert(f.Type()))
+			return nil
+		case reflect.String:
+			return setNumber(f, rv.String())
+		}
+	case reflect.Bool:
+		if n, ok := v.(int64); ok {
+			f.SetBool(n != 0)
+			return nil
+		}
+	}
+	return fmt.Errorf("can't assign %T to field of type %s", v, f.Type())
+}
+
+/*
+setNumber parses a numeric string, like the DECIMAL columns that are
+decoded as strings, into an int, uint or float field.
+*/
+func setNumber(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	default:
+		n, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	}
+	return nil
+}
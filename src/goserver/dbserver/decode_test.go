@@ -0,0 +1,100 @@
+package dbserver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func assertConvert(t *testing.T, driverName, typeName string, v interface{}, expected interface{}) {
+	r, err := convertValue(columnKindOf(driverName, typeName), v, time.UTC)
+	if err != nil {
+		t.Fatalf("Unexpected convert error for %s %v: %s", typeName, v, err.Error())
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Fatalf("Unexpected convert result for %s. Found %T(%v), expected %T(%v)", typeName, r, r, expected, expected)
+	}
+}
+
+func TestConvertMysqlText(t *testing.T) {
+	assertConvert(t, "mysql", "INT", []byte("5"), int64(5))
+	assertConvert(t, "mysql", "UNSIGNED BIGINT", []byte("18446744073709551615"), uint64(18446744073709551615))
+	assertConvert(t, "mysql", "DOUBLE", []byte("1.5"), 1.5)
+	assertConvert(t, "mysql", "DECIMAL", []byte("10.10"), "10.10")
+	assertConvert(t, "mysql", "VARCHAR", []byte("abc"), "abc")
+	assertConvert(t, "mysql", "BLOB", []byte{1, 2}, []byte{1, 2})
+	assertConvert(t, "mysql", "DATETIME", []byte("2016-01-02 03:04:05"), time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC))
+	assertConvert(t, "mysql", "DATETIME", []byte("0000-00-00 00:00:00"), time.Time{})
+	assertConvert(t, "mysql", "VARCHAR", nil, nil)
+}
+
+func TestConvertSqliteAffinity(t *testing.T) {
+	assertConvert(t, "sqlite3", "BIGINT UNSIGNED", int64(7), int64(7))
+	assertConvert(t, "sqlite3", "VARCHAR(20)", []byte("abc"), "abc")
+	assertConvert(t, "sqlite3", "BOOLEAN", int64(1), true)
+	assertConvert(t, "sqlite3", "", []byte("expr"), "expr")
+}
+
+func TestCheckTypeNames(t *testing.T) {
+	if err := checkTypeNames("mysql", []string{"", ""}); err == nil {
+		t.Fatal("Expected an error for a mysql result without column types")
+	}
+	for _, typeNames := range [][]string{{"INT", ""}, {}} {
+		if err := checkTypeNames("mysql", typeNames); err != nil {
+			t.Fatalf("Unexpected error for %q: %s", typeNames, err.Error())
+		}
+	}
+	if err := checkTypeNames("sqlite3", []string{""}); err != nil {
+		t.Fatalf("Unexpected error for an untyped sqlite expression: %s", err.Error())
+	}
+}
+
+func TestSetFieldNumericString(t *testing.T) {
+	var row struct {
+		Price float64
+		Count int32
+		Size  *uint16
+	}
+	v := reflect.ValueOf(&row).Elem()
+	for i, s := range []string{"10.10", "-3", "65535"} {
+		if err := setField(v.Field(i), s); err != nil {
+			t.Fatalf("Unexpected error for %q: %s", s, err.Error())
+		}
+	}
+	if row.Price != 10.10 || row.Count != -3 || row.Size == nil || *row.Size != 65535 {
+		t.Fatalf("Unexpected fields: %v %v %v", row.Price, row.Count, row.Size)
+	}
+	if err := setField(v.Field(1), "1.5"); err == nil {
+		t.Fatal("Expected an error for a fraction in an int field")
+	}
+	if err := setField(v.Field(2), "65536"); err == nil {
+		t.Fatal("Expected an error for an overflowing uint16")
+	}
+}
+
+func TestDSNLocation(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, tc := range []struct {
+		driverName, dsn string
+		loc             *time.Location
+	}{
+		{"mysql", "root:pw@tcp(db:3306)/eop", time.UTC},
+		{"mysql", "root:pw@tcp(db:3306)/eop?parseTime=true&loc=Asia%2FShanghai", shanghai},
+		{"mysql", "root:pw@tcp(db:3306)/eop?loc=Local", time.Local},
+		{"mysql", "root:pw@tcp(db:3306)/eop?loc=Nowhere", time.UTC},
+		{"sqlite3", "file:a.db?_loc=auto", time.Local},
+		{"sqlite3", "file:a.db?loc=Asia%2FShanghai", time.UTC},
+	} {
+		if loc := dsnLocation(tc.driverName, tc.dsn); loc.String() != tc.loc.String() {
+			t.Fatalf("Unexpected location of %s. Found %s, expected %s", tc.dsn, loc, tc.loc)
+		}
+	}
+
+	r, err := convertValue(kindTime, []byte("2016-01-02 03:04:05"), shanghai)
+	if err != nil || !r.(time.Time).Equal(time.Date(2016, 1, 1, 19, 4, 5, 0, time.UTC)) {
+		t.Fatalf("Unexpected time in Asia/Shanghai: %v %v", r, err)
+	}
+}
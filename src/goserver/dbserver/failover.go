@@ -0,0 +1,215 @@
+package dbserver
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"goserver/config"
+	"goserver/log"
+)
+
+/*
+A primary with FallbackDSNs has several dsns, the preferred
+DataSourceName first. When the active one goes down the next one that
+answers a ping takes over; with Failback on the preferred dsn is probed on
+every check and taken back once it has been up for FailbackAfter.
+*/
+
+func (ep *endpoint) activeIndex() int {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	return ep.active
+}
+
+func (ep *endpoint) activeDSN() string {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	return ep.dsns[ep.active]
+}
+
+/*
+order lists the dsn indexes to try, from first and wrapping around.
+*/
+func (ep *endpoint) order(first int) []int {
+	n := len(ep.dsns)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = (first + i) % n
+	}
+	return order
+}
+
+/*
+switchTo makes h, opened on dsns[i], the current handle and counts the
+move as a failback or a failover, as the caller says: a failover that
+wraps around to the preferred dsn is still a failover. It returns the
+index that was active before and the replaced handle for the caller to
+close.
+*/
+func (ep *endpoint) switchTo(i int, h *dbHandle, failback bool) (int, *dbHandle) {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	from := ep.active
+	old := ep.handle
+	ep.active = i
+	ep.handle = h
+	ep.dropProbe()
+	if i != from {
+		if failback {
+			ep.failbacks++
+		} else {
+			ep.failovers++
+		}
+	}
+	ep.preferredUpSince = time.Time{}
+	return from, old
+}
+
+/*
+probeDB returns the db kept to probe the preferred dsn. It is opened once
+and reused by every check, so a recovering primary doesn't get a new pool
+every interval; database/sql reconnects it once the primary answers.
+*/
+func (ep *endpoint) probeDB(item *DBItem) (*sql.DB, error) {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	if ep.probe == nil {
+		db, err := sql.Open(item.DriverName, ep.dsns[0])
+		if err != nil {
+			return nil, fmt.Errorf("open(%s) error:%s", config.RedactDSN(ep.dsns[0]), config.RedactString(err.Error()))
+		}
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		ep.probe = db
+	}
+	return ep.probe, nil
+}
+
+/*
+takeProbe hands the probe db over to the caller, it is not closed by
+the next switch then.
+*/
+func (ep *endpoint) takeProbe(db *sql.DB) bool {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	if ep.probe != db {
+		return false
+	}
+	ep.probe = nil
+	return true
+}
+
+/*
+dropProbe closes the probe db, the caller holds ep.lock.
+*/
+func (ep *endpoint) dropProbe() {
+	if ep.probe != nil {
+		go ep.probe.Close()
+		ep.probe = nil
+	}
+}
+
+/*
+preferredUp records a successful probe of the preferred dsn and returns
+since when it has been up without a failed probe.
+*/
+func (ep *endpoint) preferredUp(now time.Time) time.Time {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	if ep.preferredUpSince.IsZero() {
+		ep.preferredUpSince = now
+	}
+	return ep.preferredUpSince
+}
+
+func (ep *endpoint) preferredDown() {
+	ep.lock.Lock()
+	ep.preferredUpSince = time.Time{}
+	ep.lock.Unlock()
+}
+
+/*
+open opens dsn with the pool settings of the item and pings it.
+*/
+func (database *Database) open(item *DBItem, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(item.DriverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open(%s) error:%s", config.RedactDSN(dsn), config.RedactString(err.Error()))
+	}
+	db.SetMaxOpenConns(item.MaxOpenConns)
+	db.SetMaxIdleConns(item.MaxIdleConns)
+
+	ctx, cancel := database.pingContext()
+	err = db.PingContext(ctx)
+	cancel()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping(%s) error:%s", config.RedactDSN(dsn), config.RedactString(err.Error()))
+	}
+	return db, nil
+}
+
+/*
+connectFrom tries the dsns of a server from first on and keeps the first
+one that answers. When none does the server is down.
+*/
+func (database *Database) connectFrom(item *DBItem, ep *endpoint, first int) {
+	var lastErr error
+	for _, i := range ep.order(first) {
+		db, err := database.open(item, ep.dsns[i])
+		if err != nil {
+			log.Errorf("db(%s) %s", ep.name, err.Error())
+			lastErr = err
+			continue
+		}
+
+		from, old := ep.switchTo(i, ep.newHandle(item, db), false)
+		if old != nil {
+			go old.close(ep.name)
+		}
+		recovered := ep.health.succeed()
+		if i != from {
+			log.Warnf("db(%s) failover from %s to %s", ep.name, config.RedactDSN(ep.dsns[from]), config.RedactDSN(ep.dsns[i]))
+		} else if recovered {
+			log.Infof("db(%s) reconnected", ep.name)
+		}
+		return
+	}
+	ep.health.fail(lastErr, database.backoff)
+}
+
+/*
+checkFailback probes the preferred dsn of a server that failed over,
+the probe db becomes the handle of the server on failback.
+*/
+func (database *Database) checkFailback(item *DBItem, ep *endpoint, now time.Time) {
+	if item.Failback != "on" || ep.activeIndex() == 0 {
+		return
+	}
+
+	db, err := ep.probeDB(item)
+	if err == nil {
+		ctx, cancel := database.pingContext()
+		if err = db.PingContext(ctx); err != nil {
+			err = fmt.Errorf("ping(%s) error:%s", config.RedactDSN(ep.dsns[0]), config.RedactString(err.Error()))
+		}
+		cancel()
+	}
+	if err != nil {
+		ep.preferredDown()
+		log.Debugf("db(%s) failback probe %s", ep.name, err.Error())
+		return
+	}
+	if now.Sub(ep.preferredUp(now)) < item.FailbackAfter || !ep.takeProbe(db) {
+		return
+	}
+
+	db.SetMaxOpenConns(item.MaxOpenConns)
+	db.SetMaxIdleConns(item.MaxIdleConns)
+	from, old := ep.switchTo(0, ep.newHandle(item, db), true)
+	if old != nil {
+		go old.close(ep.name)
+	}
+	log.Infof("db(%s) failback from %s to %s", ep.name, config.RedactDSN(ep.dsns[from]), config.RedactDSN(ep.dsns[0]))
+}
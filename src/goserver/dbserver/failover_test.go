@@ -0,0 +1,81 @@
+package dbserver
+
+import (
+	"testing"
+	"time"
+
+	"goserver/config"
+)
+
+func TestFailover(t *testing.T) {
+	d := &Database{items: make(map[string]*DBItem), checkInterval: time.Millisecond, maxBackoff: time.Millisecond}
+	d.addItemFromConfig(config.DBItemConfig{
+		DBName:         "failover",
+		DriverName:     "flaky",
+		DataSourceName: "a",
+		FallbackDSNs:   []string{"b", "c"},
+		MaxIdleConns:   -1,
+		MaxOpenConns:   1,
+	})
+	item := d.item("failover")
+
+	assertActive := func(dsn string, failovers, failbacks int) {
+		s := item.status("failover", item.primary)
+		if s.ActiveDSN != dsn || s.State != StateUp || s.Failovers != failovers || s.Failbacks != failbacks {
+			t.Fatalf("Unexpected status. Found %s %s %d/%d, expected %s up %d/%d", s.ActiveDSN, s.State, s.Failovers, s.Failbacks, dsn, failovers, failbacks)
+		}
+	}
+
+	d.Connect()
+	assertActive("a", 0, 0)
+
+	testFlakyDriver.setBroken("a", true)
+	testFlakyDriver.setBroken("b", true)
+	for i := 0; i < downAfterFailures; i++ {
+		d.CheckHealth()
+	}
+	assertActive("c", 1, 0)
+
+	testFlakyDriver.setBroken("a", false)
+	testFlakyDriver.setBroken("b", false)
+	d.CheckHealth()
+	assertActive("c", 1, 0) //failback is off
+
+	item.Failback = "on"
+	item.FailbackAfter = time.Hour
+	opens := testFlakyDriver.openCount("a")
+	for i := 0; i < 3; i++ {
+		d.CheckHealth()
+	}
+	assertActive("c", 1, 0) //a is not up for long enough
+	if n := testFlakyDriver.openCount("a") - opens; n != 1 {
+		t.Fatalf("Unexpected connections opened by the failback probe. Found %d, expected 1", n)
+	}
+
+	item.FailbackAfter = 0
+	d.CheckHealth()
+	assertActive("a", 1, 1)
+
+	//a failover that wraps around to a is no failback
+	testFlakyDriver.setBroken("a", true)
+	for i := 0; i < downAfterFailures; i++ {
+		d.CheckHealth()
+	}
+	assertActive("b", 2, 1)
+	testFlakyDriver.setBroken("a", false)
+	testFlakyDriver.setBroken("b", true)
+	testFlakyDriver.setBroken("c", true)
+	item.Failback = "off"
+	for i := 0; i < downAfterFailures; i++ {
+		d.CheckHealth()
+	}
+	assertActive("a", 3, 1)
+	testFlakyDriver.setBroken("b", false)
+	testFlakyDriver.setBroken("c", false)
+
+	_, h, err := d.acquire("failover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.release()
+}
@@ -0,0 +1,322 @@
+package dbserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goserver/config"
+	"goserver/log"
+)
+
+const (
+	StateUp       = "up"
+	StateDegraded = "degraded"
+	StateDown     = "down"
+)
+
+/*
+A failed ping makes an item degraded, it keeps its connections and is
+still used. After downAfterFailures failed pings in a row it is down:
+the db is closed and reopened with exponential backoff.
+*/
+const downAfterFailures = 3
+
+type itemHealth struct {
+	lock          sync.Mutex
+	state         string
+	failures      int //failed checks in a row
+	lastError     string
+	lastErrorTime time.Time
+	lastSuccess   time.Time
+	nextRetry     time.Time
+}
+
+/*
+ItemStatus is a snapshot of one server of an item, Role is primary or
+replicaN. LastError is already redacted. Required is only set on the
+primary, reads fall back to it when the replicas are down.
+*/
+type ItemStatus struct {
+	DBName          string      `json:"dbname"`
+	Role            string      `json:"role"`
+	DriverName      string      `json:"driver"`
+	Required        bool        `json:"required"`
+	MaxIdleConns    int         `json:"max_idle_conns"`
+	MaxOpenConns    int         `json:"max_open_conns"`
+	Connected       int         `json:"connected"`
+	OpenConnections int         `json:"open_connections"`
+	DBStats         sql.DBStats `json:"-"`
+	ActiveDSN       string      `json:"active_dsn"`
+	Failovers       int         `json:"failovers"`
+	Failbacks       int         `json:"failbacks"`
+	StmtCacheSize   int         `json:"stmt_cache_size"`
+	StmtCacheLen    int         `json:"stmt_cache_len"`
+	StmtCacheHits   int64       `json:"stmt_cache_hits"`
+	StmtCacheMisses int64       `json:"stmt_cache_misses"`
+	State           string      `json:"state"`
+	Failures        int         `json:"failures"`
+	LastError       string      `json:"last_error,omitempty"`
+	LastErrorTime   time.Time   `json:"-"`
+	LastSuccess     time.Time   `json:"-"`
+}
+
+/*
+MarshalJSON flattens DBStats with the wait duration in milliseconds,
+like the gc pause of /serverstats, and leaves out the times never set.
+*/
+func (s ItemStatus) MarshalJSON() ([]byte, error) {
+	type plain ItemStatus
+	return json.Marshal(struct {
+		plain
+		InUse             int        `json:"in_use"`
+		Idle              int        `json:"idle"`
+		WaitCount         int64      `json:"wait_count"`
+		WaitDurationMs    float64    `json:"wait_duration_ms"`
+		MaxIdleClosed     int64      `json:"max_idle_closed"`
+		MaxLifetimeClosed int64      `json:"max_lifetime_closed"`
+		LastErrorTime     *time.Time `json:"last_error_time,omitempty"`
+		LastSuccess       *time.Time `json:"last_success,omitempty"`
+	}{
+		plain:             plain(s),
+		InUse:             s.DBStats.InUse,
+		Idle:              s.DBStats.Idle,
+		WaitCount:         s.DBStats.WaitCount,
+		WaitDurationMs:    float64(s.DBStats.WaitDuration) / float64(time.Millisecond),
+		MaxIdleClosed:     s.DBStats.MaxIdleClosed,
+		MaxLifetimeClosed: s.DBStats.MaxLifetimeClosed,
+		LastErrorTime:     timeOrNil(s.LastErrorTime),
+		LastSuccess:       timeOrNil(s.LastSuccess),
+	})
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (item *DBItem) status(dbname string, ep *endpoint) ItemStatus {
+	s := ItemStatus{
+		DBName:       dbname,
+		Role:         ep.role,
+		DriverName:   item.DriverName,
+		Required:     item.Required != "off" && ep == item.primary,
+		MaxIdleConns: item.MaxIdleConns,
+		MaxOpenConns: item.MaxOpenConns,
+	}
+	if h := ep.acquire(); h != nil {
+		s.Connected = 1
+		s.DBStats = h.db.Stats()
+		s.OpenConnections = s.DBStats.OpenConnections
+		if h.stmts != nil {
+			s.StmtCacheLen = h.stmts.len()
+		}
+		h.release()
+	}
+	s.StmtCacheSize = item.StmtCacheSize
+	s.StmtCacheHits = atomic.LoadInt64(&ep.stmtStats.hits)
+	s.StmtCacheMisses = atomic.LoadInt64(&ep.stmtStats.misses)
+	ep.lock.Lock()
+	s.ActiveDSN = config.RedactDSN(ep.dsns[ep.active])
+	s.Failovers = ep.failovers
+	s.Failbacks = ep.failbacks
+	ep.lock.Unlock()
+
+	h := &ep.health
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s.State = h.state
+	if s.State == "" {
+		s.State = StateDown
+	}
+	s.Failures = h.failures
+	s.LastError = h.lastError
+	s.LastErrorTime = h.lastErrorTime
+	s.LastSuccess = h.lastSuccess
+	return s
+}
+
+/*
+Statuses returns the state of every server of every item, sorted by
+DBName, the primary of an item comes before its replicas.
+*/
+func Statuses() []ItemStatus {
+	return GetDatabase().Statuses()
+}
+
+func (database *Database) Statuses() []ItemStatus {
+	items := database.snapshot()
+	statuses := make([]ItemStatus, 0, len(items))
+	for dbname, item := range items {
+		for _, ep := range item.endpoints() {
+			statuses = append(statuses, item.status(dbname, ep))
+		}
+	}
+	sort.Stable(byDBName(statuses))
+	return statuses
+}
+
+type byDBName []ItemStatus
+
+func (s byDBName) Len() int           { return len(s) }
+func (s byDBName) Less(i, j int) bool { return s[i].DBName < s[j].DBName }
+func (s byDBName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (h *itemHealth) succeed() (recovered bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	recovered = h.state != "" && h.state != StateUp
+	h.state = StateUp
+	h.failures = 0
+	h.lastSuccess = time.Now()
+	return recovered
+}
+
+/*
+fail records a failed check and returns the new state.
+backoff is how long a down item waits before the next reconnect.
+*/
+func (h *itemHealth) fail(err error, backoff func(failures int) time.Duration) string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := time.Now()
+	h.failures++
+	h.lastError = config.RedactString(err.Error())
+	h.lastErrorTime = now
+	if h.state == StateUp && h.failures < downAfterFailures {
+		h.state = StateDegraded
+	} else if h.state != StateDegraded || h.failures >= downAfterFailures {
+		h.state = StateDown
+		h.nextRetry = now.Add(backoff(h.failures))
+	}
+	return h.state
+}
+
+/*
+close marks an item closed on purpose, the next Connect retries it at once.
+*/
+func (h *itemHealth) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.state = StateDown
+	h.nextRetry = time.Time{}
+}
+
+func (h *itemHealth) up() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.state == StateUp
+}
+
+func (h *itemHealth) retryDue(now time.Time) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return !now.Before(h.nextRetry)
+}
+
+/*
+backoff doubles the check interval for every failure, up to maxBackoff.
+*/
+func (database *Database) backoff(failures int) time.Duration {
+	d, _, maxBackoff := database.checkTimes()
+	if d <= 0 {
+		d = time.Second
+	}
+	for i := 1; i < failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if maxBackoff > 0 && d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+func (database *Database) pingContext() (context.Context, context.CancelFunc) {
+	_, timeout, _ := database.checkTimes()
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+/*
+connectItem opens every server of an item, replacing the dbs it has.
+*/
+func (database *Database) connectItem(item *DBItem) {
+	for _, ep := range item.endpoints() {
+		database.connectEndpoint(item, ep)
+	}
+}
+
+/*
+connectEndpoint opens the db of a server and pings it, failing over to
+the next dsn if the active one doesn't answer. On failure it is down and
+no db is kept.
+*/
+func (database *Database) connectEndpoint(item *DBItem, ep *endpoint) {
+	database.connectFrom(item, ep, ep.activeIndex())
+}
+
+/*
+checkEndpoint pings a connected server, and reconnects a down one once
+its backoff has passed.
+*/
+func (database *Database) checkEndpoint(item *DBItem, ep *endpoint, now time.Time) {
+	h := ep.acquire()
+	if h == nil {
+		if ep.health.retryDue(now) {
+			database.connectEndpoint(item, ep)
+		}
+		return
+	}
+
+	ctx, cancel := database.pingContext()
+	err := h.db.PingContext(ctx)
+	cancel()
+	h.release()
+	if err == nil {
+		if ep.health.succeed() {
+			log.Infof("db(%s) is up again", ep.name)
+		}
+		database.checkFailback(item, ep, now)
+		return
+	}
+
+	switch ep.health.fail(err, database.backoff) {
+	case StateDegraded:
+		log.Warnf("db(%s) degraded, ping error:%s", ep.name, config.RedactString(err.Error()))
+	case StateDown:
+		log.Errorf("db(%s) down, ping error:%s", ep.name, config.RedactString(err.Error()))
+		if ep.disconnect(h) {
+			go h.close(ep.name)
+		}
+		if len(ep.dsns) > 1 {
+			database.connectFrom(item, ep, ep.activeIndex()+1)
+		}
+	}
+}
+
+/*
+CheckHealth checks every server at once, so one hanging server does not
+delay the others by more than the check timeout.
+*/
+func (database *Database) CheckHealth() {
+	now := time.Now()
+	var wg sync.WaitGroup
+	for _, item := range database.snapshot() {
+		for _, ep := range item.endpoints() {
+			wg.Add(1)
+			go func(item *DBItem, ep *endpoint) {
+				defer wg.Done()
+				database.checkEndpoint(item, ep, now)
+			}(item, ep)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,141 @@
+package dbserver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+flakyDriver connects and pings a dsn fine until it is set broken.
+*/
+type flakyDriver struct {
+	lock   sync.Mutex
+	broken map[string]bool
+	opens  map[string]int
+}
+
+func (d *flakyDriver) isBroken(dsn string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.broken[dsn]
+}
+
+func (d *flakyDriver) setBroken(dsn string, broken bool) {
+	d.lock.Lock()
+	d.broken[dsn] = broken
+	d.lock.Unlock()
+}
+
+func (d *flakyDriver) openCount(dsn string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.opens[dsn]
+}
+
+func (d *flakyDriver) Open(dsn string) (driver.Conn, error) {
+	d.lock.Lock()
+	d.opens[dsn]++
+	d.lock.Unlock()
+	if d.isBroken(dsn) {
+		return nil, errors.New("connection refused")
+	}
+	return &flakyConn{d, dsn}, nil
+}
+
+type flakyConn struct {
+	d   *flakyDriver
+	dsn string
+}
+
+func (c *flakyConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *flakyConn) Close() error              { return nil }
+func (c *flakyConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (c *flakyConn) Ping(ctx context.Context) error {
+	if c.d.isBroken(c.dsn) {
+		return errors.New("connection reset")
+	}
+	return nil
+}
+
+var testFlakyDriver = &flakyDriver{broken: make(map[string]bool), opens: make(map[string]int)}
+
+func init() {
+	sql.Register("flaky", testFlakyDriver)
+}
+
+func TestHealthStates(t *testing.T) {
+	d := &Database{items: make(map[string]*DBItem), checkInterval: time.Millisecond, maxBackoff: time.Millisecond * 4}
+	d.AddItem("flaky", "flaky", "flaky", -1, 1)
+
+	assertState := func(state string, connected int) {
+		s := d.item("flaky").status("flaky", d.item("flaky").primary)
+		if s.State != state || s.Connected != connected {
+			t.Fatalf("Unexpected item state. Found %s/%d, expected %s/%d", s.State, s.Connected, state, connected)
+		}
+	}
+
+	d.Connect()
+	assertState(StateUp, 1)
+
+	testFlakyDriver.setBroken("flaky", true)
+	d.CheckHealth()
+	assertState(StateDegraded, 1)
+	d.CheckHealth()
+	assertState(StateDegraded, 1)
+	d.CheckHealth()
+	assertState(StateDown, 0)
+	if s := d.item("flaky").status("flaky", d.item("flaky").primary); s.LastError == "" || s.LastErrorTime.IsZero() {
+		t.Fatal("Expected the last error to be recorded")
+	}
+
+	testFlakyDriver.setBroken("flaky", false)
+	d.CheckHealth()
+	assertState(StateDown, 0) //still in backoff
+	time.Sleep(time.Millisecond * 5)
+	d.CheckHealth()
+	assertState(StateUp, 1)
+}
+
+func TestItemStatusJSON(t *testing.T) {
+	s := ItemStatus{DBName: "db1", Role: "primary", State: StateUp, LastSuccess: time.Now()}
+	s.DBStats.WaitDuration = time.Millisecond * 1500
+	b, err := json.Marshal([]ItemStatus{s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []map[string]interface{}
+	if err := json.Unmarshal(b, &found); err != nil || len(found) != 1 {
+		t.Fatalf("Unexpected status json: %s %v", b, err)
+	}
+	m := found[0]
+	if m["dbname"] != "db1" || m["role"] != "primary" || m["state"] != StateUp || m["wait_duration_ms"] != 1500.0 {
+		t.Fatalf("Unexpected status json: %s", b)
+	}
+	if _, ok := m["last_success"]; !ok {
+		t.Fatalf("Expected last_success in %s", b)
+	}
+	for _, key := range []string{"last_error", "last_error_time", "DBStats", "DBName"} {
+		if _, ok := m[key]; ok {
+			t.Fatalf("Unexpected %s in %s", key, b)
+		}
+	}
+}
+
+func TestHealthBackoff(t *testing.T) {
+	d := &Database{checkInterval: time.Second * 5, maxBackoff: time.Second * 60}
+	expected := []time.Duration{5, 10, 20, 40, 60, 60}
+	for i, e := range expected {
+		if b := d.backoff(i + 1); b != e*time.Second {
+			t.Fatalf("Unexpected backoff after %d failures. Found %v, expected %v", i+1, b, e*time.Second)
+		}
+	}
+}
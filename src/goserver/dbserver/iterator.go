@@ -0,0 +1,173 @@
+package dbserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"goserver/config"
+	"goserver/log"
+)
+
+/*
+RowIterator streams the decoded rows of a query one at a time, so large
+results don't have to fit in memory like with QueryData:
+
+	it, err := db.Iterate("mysql1", "select * from log where day=?", day)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() {
+		record := it.Record()
+		...
+	}
+	return it.Err()
+
+It closes itself when the rows are done, on an error or when ctx is done,
+Close is still safe to call and should be deferred for early returns.
+The statement timeout of the db is not applied, a stream may run longer
+than any single statement, bound it with a deadline on ctx if needed.
+*/
+type RowIterator struct {
+	database  *Database
+	item      *DBItem
+	op        string
+	dbname    string
+	sqlstr    string
+	nargs     int
+	rows      *sql.Rows
+	cancel    context.CancelFunc
+	handle    *dbHandle
+	decoder   *rowDecoder
+	record    map[string]interface{}
+	count     int
+	begintime time.Time
+	err       error
+	closed    bool
+}
+
+func (database *Database) Iterate(dbname, sqlstr string, args ...interface{}) (*RowIterator, error) {
+	return database.IterateContext(context.Background(), dbname, sqlstr, args...)
+}
+
+func (database *Database) IterateContext(ctx context.Context, dbname, sqlstr string, args ...interface{}) (*RowIterator, error) {
+	item, h, err := database.acquireRead(ctx, dbname)
+	if err != nil {
+		return nil, err
+	}
+	it, err := database.iterate(ctx, "Iterate", dbname, item, h, sqlstr, args...)
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+	it.handle = h
+	return it, nil
+}
+
+func (database *Database) iterate(ctx context.Context, op, dbname string, item *DBItem, q queryer, sqlstr string, args ...interface{}) (*RowIterator, error) {
+	//no statement timeout, it would cut the stream, see RowIterator
+	ctx, cancel := context.WithCancel(ctx)
+
+	begintime := time.Now()
+	rows, err := q.QueryContext(ctx, sqlstr, args...)
+	if err != nil {
+		cancel()
+		item.queryDone(op, dbname, sqlstr, len(args), 0, begintime, err)
+		return nil, fmt.Errorf("db(%s) query error:%s", dbname, config.RedactString(err.Error()))
+	}
+
+	decoder, err := newRowDecoder(item.DriverName, item.location, rows)
+	if err != nil {
+		rows.Close()
+		cancel()
+		return nil, fmt.Errorf("db(%s) query error:%s", dbname, config.RedactString(err.Error()))
+	}
+
+	return &RowIterator{
+		database:  database,
+		item:      item,
+		op:        op,
+		dbname:    dbname,
+		sqlstr:    sqlstr,
+		nargs:     len(args),
+		rows:      rows,
+		cancel:    cancel,
+		decoder:   decoder,
+		begintime: begintime,
+	}, nil
+}
+
+func (it *RowIterator) Columns() []string {
+	return it.decoder.columns
+}
+
+/*
+Next moves to the next row, false means done or failed, see Err.
+Errors while iterating are *ScanError.
+*/
+func (it *RowIterator) Next() bool {
+	if it.closed {
+		return false
+	}
+	if !it.rows.Next() {
+		if err := it.rows.Err(); err != nil {
+			it.err = newScanError(it.dbname, it.count, err)
+		}
+		it.Close()
+		return false
+	}
+
+	err := it.decoder.scan(it.rows)
+	var record map[string]interface{}
+	if err == nil {
+		record, err = it.decoder.record()
+	}
+	if err != nil {
+		it.err = newScanError(it.dbname, it.count, err)
+		it.Close()
+		return false
+	}
+	it.record = record
+	it.count++
+	return true
+}
+
+/*
+Record returns the current row, the map is not reused by Next.
+*/
+func (it *RowIterator) Record() map[string]interface{} {
+	return it.record
+}
+
+func (it *RowIterator) Err() error {
+	return it.err
+}
+
+/*
+Count returns how many rows have been scanned so far.
+*/
+func (it *RowIterator) Count() int {
+	return it.count
+}
+
+func (it *RowIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.record = nil
+
+	err := it.rows.Close()
+	it.cancel()
+	if it.handle != nil {
+		it.handle.release()
+	}
+
+	if it.database.logSQLExecuteTime() {
+		log.Infof("%s(%s), rows:%d, time:%v", it.op, config.RedactString(it.sqlstr), it.count, time.Now().Sub(it.begintime))
+	}
+	it.item.queryDone(it.op, it.dbname, it.sqlstr, it.nargs, int64(it.count), it.begintime, it.err)
+	return err
+}
@@ -0,0 +1,116 @@
+package dbserver
+
+import (
+	"time"
+
+	"goserver/metrics"
+)
+
+var (
+	queriesTotal = metrics.NewCounterVec("goserver_db_queries_total",
+		"Queries run on a dbitem by operation, result is success or error.",
+		"dbname", "op", "result")
+	queryDuration = metrics.NewHistogramVec("goserver_db_query_duration_seconds",
+		"Time to run a query on a dbitem by operation, reading the rows included.",
+		metrics.DefBuckets, "dbname", "op")
+)
+
+func init() {
+	metrics.Register(metrics.CollectorFunc(collectDBStats))
+}
+
+/*
+queryDone is called once for every query when it is done, rows read or
+not, to record it in the metrics and the slow log.
+*/
+func (item *DBItem) queryDone(op, dbname, sqlstr string, nargs int, rows int64, begintime time.Time, err error) {
+	elapsed := time.Now().Sub(begintime)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	queriesTotal.With(dbname, op, result).Inc()
+	queryDuration.With(dbname, op).Observe(elapsed.Seconds())
+	item.logSlow(op, dbname, sqlstr, nargs, rows, elapsed, err)
+}
+
+/*
+collectDBStats reads the health of every server and the sql.DBStats of
+the connected ones.
+*/
+func collectDBStats() []metrics.Family {
+	if database == nil {
+		return nil
+	}
+	return database.collectDBStats()
+}
+
+func (database *Database) collectDBStats() []metrics.Family {
+	statuses := database.Statuses()
+	return append(collectPoolStats(statuses), collectHealth(statuses)...)
+}
+
+func collectPoolStats(statuses []ItemStatus) []metrics.Family {
+	gauge := func(name, help string) metrics.Family {
+		return metrics.Family{Name: name, Help: help, Type: metrics.TypeGauge, LabelNames: []string{"dbname", "role"}}
+	}
+	counter := func(name, help string) metrics.Family {
+		return metrics.Family{Name: name, Help: help, Type: metrics.TypeCounter, LabelNames: []string{"dbname", "role"}}
+	}
+	families := []metrics.Family{
+		gauge("goserver_db_max_open_connections", "Maximum number of open connections to the database."),
+		gauge("goserver_db_open_connections", "Established connections, in use and idle."),
+		gauge("goserver_db_in_use_connections", "Connections currently in use."),
+		gauge("goserver_db_idle_connections", "Idle connections."),
+		counter("goserver_db_wait_count_total", "Connections waited for."),
+		counter("goserver_db_wait_duration_seconds_total", "Time blocked waiting for a new connection."),
+		counter("goserver_db_max_idle_closed_total", "Connections closed due to MaxIdleConns."),
+		counter("goserver_db_max_lifetime_closed_total", "Connections closed due to the connection max lifetime."),
+	}
+	for _, s := range statuses {
+		if s.Connected == 0 {
+			continue
+		}
+		labels := []string{s.DBName, s.Role}
+		values := []float64{
+			float64(s.DBStats.MaxOpenConnections),
+			float64(s.DBStats.OpenConnections),
+			float64(s.DBStats.InUse),
+			float64(s.DBStats.Idle),
+			float64(s.DBStats.WaitCount),
+			s.DBStats.WaitDuration.Seconds(),
+			float64(s.DBStats.MaxIdleClosed),
+			float64(s.DBStats.MaxLifetimeClosed),
+		}
+		for i, v := range values {
+			families[i].Metrics = append(families[i].Metrics, metrics.Metric{LabelValues: labels, Value: v})
+		}
+	}
+	return families
+}
+
+/*
+collectHealth exports the state of a server as one series per state,
+1 for the current one, so alerts can match on the state label.
+*/
+func collectHealth(statuses []ItemStatus) []metrics.Family {
+	state := metrics.Family{Name: "goserver_db_state", Help: "Health state of a dbitem server, 1 for the current state.",
+		Type: metrics.TypeGauge, LabelNames: []string{"dbname", "role", "state"}}
+	failovers := metrics.Family{Name: "goserver_db_failovers_total", Help: "Switches of a dbitem server to a fallback dsn.",
+		Type: metrics.TypeCounter, LabelNames: []string{"dbname", "role"}}
+	failbacks := metrics.Family{Name: "goserver_db_failbacks_total", Help: "Switches of a dbitem server back to its preferred dsn.",
+		Type: metrics.TypeCounter, LabelNames: []string{"dbname", "role"}}
+	for _, s := range statuses {
+		for _, st := range []string{StateUp, StateDegraded, StateDown} {
+			v := 0.0
+			if s.State == st {
+				v = 1
+			}
+			state.Metrics = append(state.Metrics, metrics.Metric{LabelValues: []string{s.DBName, s.Role, st}, Value: v})
+		}
+		labels := []string{s.DBName, s.Role}
+		failovers.Metrics = append(failovers.Metrics, metrics.Metric{LabelValues: labels, Value: float64(s.Failovers)})
+		failbacks.Metrics = append(failbacks.Metrics, metrics.Metric{LabelValues: labels, Value: float64(s.Failbacks)})
+	}
+	return []metrics.Family{state, failovers, failbacks}
+}
@@ -0,0 +1,30 @@
+package dbserver
+
+import (
+	"testing"
+)
+
+func TestQueryMetrics(t *testing.T) {
+	d := newTestDatabase(t)
+	//the counters are shared by the test databases, all named test
+	success := queriesTotal.With("test", "Exec", "success").Value()
+	failed := queriesTotal.With("test", "Exec", "error").Value()
+	d.Exec("test", "insert into t values(1, 'a')")
+	d.Exec("test", "insert into nosuchtable values(1)")
+	d.QueryData("test", "select * from t")
+
+	if n := queriesTotal.With("test", "Exec", "success").Value() - success; n != 1 {
+		t.Fatalf("Unexpected successful Exec count. Found %v, expected 1", n)
+	}
+	if n := queriesTotal.With("test", "Exec", "error").Value() - failed; n != 1 {
+		t.Fatalf("Unexpected failed Exec count. Found %v, expected 1", n)
+	}
+	if m := queryDuration.Collect()[0].Metrics; len(m) == 0 || m[0].Count == 0 {
+		t.Fatalf("Unexpected query durations: %+v", m)
+	}
+
+	families := d.collectDBStats()
+	if families[1].Name != "goserver_db_open_connections" || len(families[1].Metrics) != 1 || families[1].Metrics[0].Value < 1 {
+		t.Fatalf("Unexpected db stats: %+v", families[1])
+	}
+}
@@ -0,0 +1,321 @@
+package dbserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"goserver/config"
+	"goserver/log"
+)
+
+/*
+queryer is what the helpers below need, *sql.Tx has it and so does
+dbHandle, which adds the statement cache of the item.
+*/
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+/*
+Rows releases the statement timeout and the db of its query on Close,
+and counts the rows read for the slow log.
+*/
+type Rows struct {
+	*sql.Rows
+	cancel    context.CancelFunc
+	handle    *dbHandle
+	item      *DBItem
+	op        string
+	dbname    string
+	sqlstr    string
+	nargs     int
+	count     int64
+	begintime time.Time
+	closed    bool
+}
+
+func (rows *Rows) Next() bool {
+	if !rows.Rows.Next() {
+		return false
+	}
+	rows.count++
+	return true
+}
+
+func (rows *Rows) Close() error {
+	err := rows.Rows.Close()
+	rows.cancel()
+	if rows.handle != nil {
+		rows.handle.release()
+		rows.handle = nil
+	}
+	if !rows.closed {
+		rows.closed = true
+		rows.item.queryDone(rows.op, rows.dbname, rows.sqlstr, rows.nargs, rows.count, rows.begintime, rows.Rows.Err())
+	}
+	return err
+}
+
+/*
+SQL text goes through config.RedactString before it is logged,
+a password in an ALTER USER or a literal DSN must not reach the log files.
+*/
+func (database *Database) logExecuteTime(op, sqlstr string, begintime time.Time) {
+	if database.logSQLExecuteTime() {
+		log.Infof("%s(%s), time:%v", op, config.RedactString(sqlstr), time.Now().Sub(begintime))
+	}
+}
+
+/*
+withTimeout bounds ctx by the statement timeout of the item,
+an earlier deadline already set on ctx is kept.
+*/
+func (item *DBItem) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if item.StatementTimeout > 0 {
+		return context.WithTimeout(ctx, item.StatementTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+/*
+You should remember to close Rows.
+Use ? placeholders with args instead of building sqlstr by hand,
+the args are sent to the driver and never spliced into the SQL text.
+*/
+func (database *Database) Query(dbname, sqlstr string, args ...interface{}) (*Rows, error) {
+	return database.QueryContext(context.Background(), dbname, sqlstr, args...)
+}
+
+/*
+The query is aborted when ctx is done or the statement timeout of the db
+expires, pass gin's c.Request.Context() so a client disconnect aborts it.
+*/
+func (database *Database) QueryContext(ctx context.Context, dbname, sqlstr string, args ...interface{}) (*Rows, error) {
+	item, h, err := database.acquireRead(ctx, dbname)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := database.query(ctx, "Query", dbname, item, h, sqlstr, args...)
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+	rows.handle = h
+	return rows, nil
+}
+
+func (database *Database) query(ctx context.Context, op, dbname string, item *DBItem, q queryer, sqlstr string, args ...interface{}) (*Rows, error) {
+	ctx, cancel := item.withTimeout(ctx)
+
+	begintime := time.Now()
+	rows, err := q.QueryContext(ctx, sqlstr, args...)
+	database.logExecuteTime(op, sqlstr, begintime)
+	if err != nil {
+		cancel()
+		item.queryDone(op, dbname, sqlstr, len(args), 0, begintime, err)
+		return nil, fmt.Errorf("db(%s) query error:%s", dbname, config.RedactString(err.Error()))
+	}
+
+	return &Rows{
+		Rows:      rows,
+		cancel:    cancel,
+		item:      item,
+		op:        op,
+		dbname:    dbname,
+		sqlstr:    sqlstr,
+		nargs:     len(args),
+		begintime: begintime,
+	}, nil
+}
+
+/*
+This function is for small results, use Iterate for large ones.
+It is strict: the first row that fails to scan or decode, or a failed
+iteration, makes it return a *ScanError and no records.
+*/
+func (database *Database) QueryData(dbname, sqlstr string, args ...interface{}) (int, *[]map[string]interface{}, error) {
+	return database.QueryDataContext(context.Background(), dbname, sqlstr, args...)
+}
+
+func (database *Database) QueryDataContext(ctx context.Context, dbname, sqlstr string, args ...interface{}) (int, *[]map[string]interface{}, error) {
+	item, h, err := database.acquireRead(ctx, dbname)
+	if err != nil {
+		return -1, nil, err
+	}
+	defer h.release()
+	count, records, _, err := database.queryData(ctx, "QueryData", dbname, item, h, false, sqlstr, args...)
+	return count, records, err
+}
+
+/*
+QueryDataLenient skips the rows that fail to scan or decode and returns
+them as scanErrors next to the good records. A failed iteration ends the
+result and is the last of scanErrors, with Row set to the rows read.
+*/
+func (database *Database) QueryDataLenient(dbname, sqlstr string, args ...interface{}) (int, *[]map[string]interface{}, []*ScanError, error) {
+	return database.QueryDataLenientContext(context.Background(), dbname, sqlstr, args...)
+}
+
+func (database *Database) QueryDataLenientContext(ctx context.Context, dbname, sqlstr string, args ...interface{}) (int, *[]map[string]interface{}, []*ScanError, error) {
+	item, h, err := database.acquireRead(ctx, dbname)
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	defer h.release()
+	return database.queryData(ctx, "QueryDataLenient", dbname, item, h, true, sqlstr, args...)
+}
+
+func (database *Database) queryData(ctx context.Context, op, dbname string, item *DBItem, q queryer, lenient bool, sqlstr string, args ...interface{}) (count int, records *[]map[string]interface{}, scanErrors []*ScanError, err error) {
+	ctx, cancel := item.withTimeout(ctx)
+	defer cancel()
+
+	begintime := time.Now()
+	defer func() {
+		item.queryDone(op, dbname, sqlstr, len(args), int64(count), begintime, err)
+	}()
+	rows, err := q.QueryContext(ctx, sqlstr, args...)
+	if err != nil {
+		return -1, nil, nil, fmt.Errorf("db(%s) query error:%s", dbname, config.RedactString(err.Error()))
+	}
+	defer rows.Close()
+
+	database.logExecuteTime(op, sqlstr, begintime)
+
+	decoder, err := newRowDecoder(item.DriverName, item.location, rows)
+	if err != nil {
+		return -1, nil, nil, fmt.Errorf("db(%s) query error:%s", dbname, config.RedactString(err.Error()))
+	}
+
+	result := make([]map[string]interface{}, 0)
+	for row := 0; rows.Next(); row++ {
+		err := decoder.scan(rows)
+		var record map[string]interface{}
+		if err == nil {
+			record, err = decoder.record()
+		}
+		if err != nil {
+			if !lenient {
+				return -1, nil, nil, newScanError(dbname, row, err)
+			}
+			scanErrors = append(scanErrors, newScanError(dbname, row, err))
+			continue
+		}
+		result = append(result, record)
+	}
+	if err := rows.Err(); err != nil {
+		scanError := newScanError(dbname, len(result)+len(scanErrors), err)
+		if !lenient {
+			return -1, nil, nil, scanError
+		}
+		scanErrors = append(scanErrors, scanError)
+	}
+
+	/*
+		for row := range records {
+			for k, v := range records[row] {
+				println(k, ":", v)
+			}
+		}
+	*/
+	return len(result), &result, scanErrors, nil
+}
+
+/*
+QueryInto appends one element to dest, a pointer to a slice of struct or
+of struct pointer, for each row. Columns are matched to fields by the db
+tag, or by the field name ignoring case; columns without a field are
+skipped. Fields may be sql.Scanner, pointers (nil for NULL) or plain types.
+
+	var users []User
+	n, err := db.QueryInto("mysql1", &users, "select id, name from user where age>?", 18)
+*/
+func (database *Database) QueryInto(dbname string, dest interface{}, sqlstr string, args ...interface{}) (int, error) {
+	return database.QueryIntoContext(context.Background(), dbname, dest, sqlstr, args...)
+}
+
+func (database *Database) QueryIntoContext(ctx context.Context, dbname string, dest interface{}, sqlstr string, args ...interface{}) (int, error) {
+	item, h, err := database.acquireRead(ctx, dbname)
+	if err != nil {
+		return -1, err
+	}
+	defer h.release()
+	return database.queryInto(ctx, "QueryInto", dbname, item, h, dest, sqlstr, args...)
+}
+
+func (database *Database) queryInto(ctx context.Context, op, dbname string, item *DBItem, q queryer, dest interface{}, sqlstr string, args ...interface{}) (count int, err error) {
+	ctx, cancel := item.withTimeout(ctx)
+	defer cancel()
+
+	begintime := time.Now()
+	defer func() {
+		item.queryDone(op, dbname, sqlstr, len(args), int64(count), begintime, err)
+	}()
+	rows, err := q.QueryContext(ctx, sqlstr, args...)
+	if err != nil {
+		return -1, fmt.Errorf("db(%s) query error:%s", dbname, config.RedactString(err.Error()))
+	}
+	defer rows.Close()
+
+	database.logExecuteTime(op, sqlstr, begintime)
+
+	decoder, err := newRowDecoder(item.DriverName, item.location, rows)
+	if err != nil {
+		return -1, fmt.Errorf("db(%s) query error:%s", dbname, config.RedactString(err.Error()))
+	}
+	sd, err := newStructDecoder(dest, decoder.columns)
+	if err != nil {
+		return -1, fmt.Errorf("db(%s) %s", dbname, err.Error())
+	}
+
+	for rows.Next() {
+		if err := decoder.scan(rows); err != nil {
+			return -1, newScanError(dbname, count, err)
+		}
+		if err := sd.appendRow(decoder); err != nil {
+			return -1, newScanError(dbname, count, err)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return -1, newScanError(dbname, count, err)
+	}
+	return count, nil
+}
+
+func (database *Database) Exec(dbname, sqlstr string, args ...interface{}) (int64, int64, error) {
+	return database.ExecContext(context.Background(), dbname, sqlstr, args...)
+}
+
+func (database *Database) ExecContext(ctx context.Context, dbname, sqlstr string, args ...interface{}) (int64, int64, error) {
+	item, h, err := database.acquire(dbname)
+	if err != nil {
+		return -1, -1, err
+	}
+	defer h.release()
+	return database.exec(ctx, "Exec", dbname, item, h, sqlstr, args...)
+}
+
+func (database *Database) exec(ctx context.Context, op, dbname string, item *DBItem, q queryer, sqlstr string, args ...interface{}) (lastId int64, affectCnt int64, err error) {
+	ctx, cancel := item.withTimeout(ctx)
+	defer cancel()
+
+	begintime := time.Now()
+	defer func() {
+		item.queryDone(op, dbname, sqlstr, len(args), affectCnt, begintime, err)
+	}()
+
+	res, err := q.ExecContext(ctx, sqlstr, args...)
+	if err != nil {
+		return -1, -1, fmt.Errorf("db(%s) exec error:%s", dbname, config.RedactString(err.Error()))
+	}
+
+	database.logExecuteTime(op, sqlstr, begintime)
+
+	affectCnt, _ = res.RowsAffected()
+	lastId, _ = res.LastInsertId()
+
+	return lastId, affectCnt, nil
+}
@@ -0,0 +1,74 @@
+package dbserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+endlessSQL counts without end, only a timeout or a cancel stops it.
+*/
+const endlessSQL = "with recursive c(x) as (select 1 union all select x+1 from c) select count(*) as n from c"
+
+func assertAborted(t *testing.T, err error, want error) {
+	t.Helper()
+	if err == nil || !strings.Contains(err.Error(), want.Error()) {
+		t.Fatalf("want error with %q, got %v", want, err)
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	d := newTestDatabase(t)
+	d.item("test").StatementTimeout = 50 * time.Millisecond
+
+	begin := time.Now()
+	_, _, err := d.QueryData("test", endlessSQL)
+	assertAborted(t, err, context.DeadlineExceeded)
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Fatalf("query took %v", elapsed)
+	}
+
+	_, _, err = d.Exec("test", "insert into t(id) select count(*) from ("+endlessSQL+")")
+	assertAborted(t, err, context.DeadlineExceeded)
+}
+
+func TestCancelledContext(t *testing.T) {
+	d := newTestDatabase(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, _, err := d.QueryDataContext(ctx, "test", endlessSQL)
+	assertAborted(t, err, context.Canceled)
+
+	_, _, err = d.ExecContext(ctx, "test", "insert into t(id) select count(*) from ("+endlessSQL+")")
+	assertAborted(t, err, context.Canceled)
+}
+
+func TestIterateOutlivesStatementTimeout(t *testing.T) {
+	d := newTestDatabase(t)
+	for i := 1; i <= 3; i++ {
+		if _, _, err := d.Exec("test", "insert into t(id, name) values(?, ?)", i, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.item("test").StatementTimeout = 50 * time.Millisecond
+
+	it, err := d.Iterate("test", "select id from t order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		n++
+		time.Sleep(40 * time.Millisecond)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iteration cut: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("want 3 rows, got %d", n)
+	}
+}
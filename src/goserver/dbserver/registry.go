@@ -0,0 +1,194 @@
+package dbserver
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goserver/log"
+)
+
+/*
+dbHandle is one opened *sql.DB of an endpoint. Every query holds a
+reference while it uses the db, so a reconnect or a removal can swap the
+handle out at any time and close it once the last query is done.
+*/
+type dbHandle struct {
+	db       *sql.DB
+	stmts    *stmtCache //nil:no statement cache
+	refs     sync.WaitGroup
+	inflight int32
+}
+
+func (h *dbHandle) release() {
+	atomic.AddInt32(&h.inflight, -1)
+	h.refs.Done()
+}
+
+func (h *dbHandle) inUse() int32 {
+	return atomic.LoadInt32(&h.inflight)
+}
+
+/*
+close waits for the queries holding h, then closes its db.
+*/
+func (h *dbHandle) close(name string) {
+	h.refs.Wait()
+	if err := h.db.Close(); err != nil {
+		log.Errorf("db(%s) close error:%s", name, err.Error())
+	}
+}
+
+/*
+endpoint is one server of an item, the primary or a replica.
+name is the dbname for the primary and dbname/replicaN for replicas.
+dsns holds more than one dsn only for a primary with FallbackDSNs.
+*/
+type endpoint struct {
+	name             string
+	role             string
+	dsns             []string
+	lock             sync.Mutex
+	active           int       //index in dsns
+	handle           *dbHandle //nil:notconnected
+	failovers        int
+	failbacks        int
+	preferredUpSince time.Time
+	probe            *sql.DB //kept to probe dsns[0] for failback
+	stmtStats        stmtStats
+	health           itemHealth
+}
+
+func (ep *endpoint) newHandle(item *DBItem, db *sql.DB) *dbHandle {
+	h := &dbHandle{db: db}
+	if item.StmtCacheSize > 0 {
+		h.stmts = newStmtCache(item.StmtCacheSize, &ep.stmtStats)
+	}
+	return h
+}
+
+/*
+acquire returns the current db of the endpoint with a reference taken,
+or nil when it is not connected.
+*/
+func (ep *endpoint) acquire() *dbHandle {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	if ep.handle == nil {
+		return nil
+	}
+	ep.handle.refs.Add(1)
+	atomic.AddInt32(&ep.handle.inflight, 1)
+	return ep.handle
+}
+
+/*
+detach disconnects the endpoint and returns its handle for the caller
+to close.
+*/
+func (ep *endpoint) detach() *dbHandle {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	old := ep.handle
+	ep.handle = nil
+	ep.dropProbe()
+	return old
+}
+
+/*
+disconnect drops h if it is still the current handle, a reconnect that
+happened meanwhile is kept.
+*/
+func (ep *endpoint) disconnect(h *dbHandle) bool {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	if ep.handle != h {
+		return false
+	}
+	ep.handle = nil
+	return true
+}
+
+func (ep *endpoint) connected() bool {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	return ep.handle != nil
+}
+
+/*
+retire disconnects the endpoint, its db is closed in background once the
+queries still using it are done.
+*/
+func (ep *endpoint) retire() {
+	if old := ep.detach(); old != nil {
+		go old.close(ep.name)
+	}
+}
+
+/*
+endpoints returns the primary first, then the replicas.
+*/
+func (item *DBItem) endpoints() []*endpoint {
+	return append([]*endpoint{item.primary}, item.replicas...)
+}
+
+func (item *DBItem) connected() bool {
+	return item.primary.connected()
+}
+
+func (item *DBItem) retire() {
+	for _, ep := range item.endpoints() {
+		ep.retire()
+	}
+}
+
+func (database *Database) item(dbname string) *DBItem {
+	database.lock.RLock()
+	defer database.lock.RUnlock()
+	return database.items[dbname]
+}
+
+/*
+snapshot copies the registry so it can be walked without holding the lock.
+*/
+func (database *Database) snapshot() map[string]*DBItem {
+	database.lock.RLock()
+	defer database.lock.RUnlock()
+	items := make(map[string]*DBItem, len(database.items))
+	for dbname, item := range database.items {
+		items[dbname] = item
+	}
+	return items
+}
+
+/*
+putItem registers item under dbname and retires the item it replaces.
+*/
+func (database *Database) putItem(dbname string, item *DBItem) {
+	database.lock.Lock()
+	old := database.items[dbname]
+	database.items[dbname] = item
+	database.lock.Unlock()
+
+	if old != nil && old != item {
+		old.retire()
+	}
+}
+
+/*
+acquire returns the item and its primary db for one query, the caller
+must release the handle when the query and its rows are done.
+*/
+func (database *Database) acquire(dbname string) (*DBItem, *dbHandle, error) {
+	item := database.item(dbname)
+	if item == nil {
+		return nil, nil, fmt.Errorf("db(%s) not found", dbname)
+	}
+	h := item.primary.acquire()
+	if h == nil {
+		return nil, nil, fmt.Errorf("db(%s) not connected", dbname)
+	}
+	return item, h, nil
+}
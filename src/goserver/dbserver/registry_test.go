@@ -0,0 +1,138 @@
+package dbserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Run these with -race, they are about what the race detector sees.
+*/
+
+func insertTestRows(t *testing.T, d *Database, n int) {
+	for i := 0; i < n; i++ {
+		if _, _, err := d.Exec("test", "insert into t values(?, ?)", i, "name"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+/*
+runQueries runs every kind of query from several goroutines until stop
+is closed, and reports the errors not accepted by allowed.
+*/
+func runQueries(t *testing.T, d *Database, stop chan struct{}, allowed func(err error) bool) *sync.WaitGroup {
+	check := func(err error) {
+		if err != nil && !allowed(err) {
+			t.Error(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				_, _, err := d.QueryData("test", "select * from t where id<?", 5)
+				check(err)
+
+				it, err := d.Iterate("test", "select * from t")
+				check(err)
+				if err == nil {
+					for it.Next() {
+					}
+					check(it.Err())
+					it.Close()
+				}
+
+				check(d.WithTx("test", nil, func(tx *Tx) error {
+					_, _, err := tx.QueryData("select count(*) from t")
+					return err
+				}))
+
+				d.Statuses()
+			}
+		}()
+	}
+	return &wg
+}
+
+func TestConcurrentQueriesDuringReconnect(t *testing.T) {
+	d := newTestDatabase(t)
+	insertTestRows(t, d, 20)
+
+	stop := make(chan struct{})
+	wg := runQueries(t, d, stop, func(err error) bool { return false })
+
+	for i := 0; i < 50; i++ {
+		d.connectItem(d.item("test"))
+		d.CheckHealth()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestConcurrentQueriesDuringRemoval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "test.db")
+
+	d := newDatabase()
+	d.AddItem("test", "sqlite3", dsn, 4, 4)
+	d.Connect()
+	if _, _, err := d.Exec("test", "create table t(id integer, name text)"); err != nil {
+		t.Fatal(err)
+	}
+	insertTestRows(t, d, 20)
+
+	stop := make(chan struct{})
+	wg := runQueries(t, d, stop, func(err error) bool {
+		return strings.HasSuffix(err.Error(), "not found") || strings.HasSuffix(err.Error(), "not connected")
+	})
+
+	for i := 0; i < 50; i++ {
+		d.DelItem("test")
+		d.AddItem("test", "sqlite3", dsn, 4, 4)
+		d.Connect()
+		d.ReplaceItem("test", "sqlite3", dsn, 4, 4)
+	}
+	close(stop)
+	wg.Wait()
+	d.Close()
+}
+
+func TestRemoveWaitsForRows(t *testing.T) {
+	d := newTestDatabase(t)
+	insertTestRows(t, d, 3)
+
+	it, err := d.Iterate("test", "select * from t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.DelItem("test")
+	time.Sleep(time.Millisecond * 10)
+
+	for it.Next() {
+	}
+	if it.Err() != nil || it.Count() != 3 {
+		t.Fatalf("Unexpected iteration after DelItem. Found %d rows and error %v, expected 3 rows", it.Count(), it.Err())
+	}
+	if _, _, err := d.QueryData("test", "select * from t"); err == nil || !strings.HasSuffix(err.Error(), "not found") {
+		t.Fatalf("Unexpected QueryData error after DelItem: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package dbserver
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	PolicyRoundRobin = "round_robin"
+	PolicyLeastConn  = "least_conn"
+)
+
+type forcePrimaryKey struct{}
+
+/*
+ForcePrimary makes the reads done with ctx go to the primary, for reading
+your own writes before the replicas catch up:
+
+	db.ExecContext(ctx, "mysql1", "update user set name=? where id=?", name, id)
+	db.QueryDataContext(dbserver.ForcePrimary(ctx), "mysql1", "select * from user where id=?", id)
+*/
+func ForcePrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forcePrimaryKey{}, true)
+}
+
+func primaryForced(ctx context.Context) bool {
+	forced, _ := ctx.Value(forcePrimaryKey{}).(bool)
+	return forced
+}
+
+/*
+pickReplica returns a healthy replica by the policy of the item, with a
+reference taken, or nil when none is up. Replicas that are degraded or
+down are ejected until a health check sees them up again.
+*/
+func (item *DBItem) pickReplica() *dbHandle {
+	n := len(item.replicas)
+	if item.ReplicaPolicy == PolicyLeastConn {
+		var best *dbHandle
+		for _, ep := range item.replicas {
+			if !ep.health.up() {
+				continue
+			}
+			h := ep.acquire()
+			if h == nil {
+				continue
+			}
+			if best == nil || h.inUse() < best.inUse() {
+				if best != nil {
+					best.release()
+				}
+				best = h
+			} else {
+				h.release()
+			}
+		}
+		return best
+	}
+
+	start := int(atomic.AddUint32(&item.next, 1))
+	for i := 0; i < n; i++ {
+		ep := item.replicas[(start+i)%n]
+		if !ep.health.up() {
+			continue
+		}
+		if h := ep.acquire(); h != nil {
+			return h
+		}
+	}
+	return nil
+}
+
+/*
+acquireRead is acquire for reads: they go to a replica when the item has
+one up, and to the primary otherwise or when ctx forces it.
+*/
+func (database *Database) acquireRead(ctx context.Context, dbname string) (*DBItem, *dbHandle, error) {
+	item := database.item(dbname)
+	if item == nil {
+		return nil, nil, fmt.Errorf("db(%s) not found", dbname)
+	}
+	if len(item.replicas) > 0 && !primaryForced(ctx) {
+		if h := item.pickReplica(); h != nil {
+			return item, h, nil
+		}
+	}
+	h := item.primary.acquire()
+	if h == nil {
+		return nil, nil, fmt.Errorf("db(%s) not connected", dbname)
+	}
+	return item, h, nil
+}
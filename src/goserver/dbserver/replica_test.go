@@ -0,0 +1,122 @@
+package dbserver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"goserver/config"
+)
+
+/*
+newReplicaDatabase returns an item "test" with a primary and two replicas,
+each a SQLite file whose table t has one row naming the server.
+*/
+func newReplicaDatabase(t *testing.T, policy string) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "dbserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.DBItemConfig{
+		DBName:         "test",
+		DriverName:     "sqlite3",
+		DataSourceName: filepath.Join(dir, "primary.db"),
+		Replicas:       []string{filepath.Join(dir, "replica0.db"), filepath.Join(dir, "replica1.db")},
+		ReplicaPolicy:  policy,
+		MaxIdleConns:   2,
+		MaxOpenConns:   2,
+	}
+	d := newDatabase()
+	d.addItemFromConfig(c)
+	d.Connect()
+
+	for _, ep := range d.item("test").endpoints() {
+		h := ep.acquire()
+		if h == nil {
+			t.Fatalf("Can't connect to %s", ep.name)
+		}
+		if _, err := h.db.Exec("create table t(name text)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.db.Exec("insert into t values(?)", ep.role); err != nil {
+			t.Fatal(err)
+		}
+		h.release()
+	}
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readServer(t *testing.T, d *Database, ctx context.Context) string {
+	_, records, err := d.QueryDataContext(ctx, "test", "select name from t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return (*records)[0]["name"].(string)
+}
+
+func TestReplicaRouting(t *testing.T) {
+	d, cleanup := newReplicaDatabase(t, "")
+	defer cleanup()
+	ctx := context.Background()
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[readServer(t, d, ctx)]++
+	}
+	if seen["replica0"] != 2 || seen["replica1"] != 2 {
+		t.Fatalf("Unexpected round robin reads: %v", seen)
+	}
+
+	if server := readServer(t, d, ForcePrimary(ctx)); server != "primary" {
+		t.Fatalf("Unexpected server for a forced primary read. Found %s, expected primary", server)
+	}
+
+	if _, _, err := d.Exec("test", "update t set name='written'"); err != nil {
+		t.Fatal(err)
+	}
+	if server := readServer(t, d, ForcePrimary(ctx)); server != "written" {
+		t.Fatalf("Exec didn't go to the primary. Found %s, expected written", server)
+	}
+
+	err := d.WithTx("test", nil, func(tx *Tx) error {
+		_, records, err := tx.QueryData("select name from t")
+		if err == nil && (*records)[0]["name"] != "written" {
+			err = errors.New("transaction didn't run on the primary")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicaEjection(t *testing.T) {
+	d, cleanup := newReplicaDatabase(t, "least_conn")
+	defer cleanup()
+	ctx := context.Background()
+	item := d.item("test")
+
+	item.replicas[0].health.fail(errors.New("ping timeout"), d.backoff)
+	for i := 0; i < 3; i++ {
+		if server := readServer(t, d, ctx); server != "replica1" {
+			t.Fatalf("Unexpected server with replica0 ejected. Found %s, expected replica1", server)
+		}
+	}
+
+	item.replicas[1].retire()
+	if server := readServer(t, d, ctx); server != "primary" {
+		t.Fatalf("Unexpected server with no replica up. Found %s, expected primary", server)
+	}
+
+	d.CheckHealth()
+	if server := readServer(t, d, ctx); server == "primary" {
+		t.Fatal("Replicas were not taken back after a successful health check")
+	}
+}
@@ -0,0 +1,59 @@
+package dbserver
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"goserver/config"
+	"goserver/log"
+)
+
+/*
+maxSlowSQLLen bounds the SQL text of a slow log line, generated IN lists
+can be megabytes.
+*/
+const maxSlowSQLLen = 1000
+
+/*
+logSlow writes a done query of the item to the slow log: at Warn when it took
+SlowThreshold or more, failed ones included, and a FastSampleRate share
+of the others at Info. Bind args are never logged, only their count.
+*/
+func (item *DBItem) logSlow(op, dbname, sqlstr string, nargs int, rows int64, elapsed time.Duration, err error) {
+	if rows < 0 {
+		rows = 0
+	}
+	if item.SlowThreshold > 0 && elapsed >= item.SlowThreshold {
+		log.SlowWarnf("db(%s) %s slow, time:%v, rows:%d, %s", dbname, op, elapsed, rows, slowSQL(sqlstr, nargs, err))
+		return
+	}
+	if item.FastSampleRate > 0 && rand.Float64() < item.FastSampleRate {
+		log.SlowInfof("db(%s) %s sampled, time:%v, rows:%d, %s", dbname, op, elapsed, rows, slowSQL(sqlstr, nargs, err))
+	}
+}
+
+func slowSQL(sqlstr string, nargs int, err error) string {
+	s := "sql:" + truncateSQL(config.RedactString(sqlstr), maxSlowSQLLen)
+	if nargs > 0 {
+		s += ", args:" + strconv.Itoa(nargs) + " redacted"
+	}
+	if err != nil {
+		s += ", error:" + config.RedactString(err.Error())
+	}
+	return s
+}
+
+/*
+truncateSQL cuts s to at most n bytes without splitting a character.
+*/
+func truncateSQL(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,99 @@
+package dbserver
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+	"goserver/log"
+)
+
+func captureSlowLog(t *testing.T) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	logger, err := seelog.LoggerFromWriterWithMinLevelAndFormat(buf, seelog.TraceLvl, "%LEV %Msg%n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.ReplaceSlowLogger(logger)
+	return buf
+}
+
+func TestSlowLog(t *testing.T) {
+	buf := captureSlowLog(t)
+	defer log.ReplaceSlowLogger(nil)
+
+	d := newTestDatabase(t)
+	item := d.item("test")
+	d.Exec("test", "insert into t values(1, 'secret'), (2, 'b')")
+
+	item.SlowThreshold = time.Hour
+	d.QueryData("test", "select * from t where name=?", "secret")
+	log.Flush()
+	if buf.Len() != 0 {
+		t.Fatalf("Unexpected slow log of a fast query: %q", buf.String())
+	}
+
+	item.SlowThreshold = time.Nanosecond
+	d.QueryData("test", "select * from t where name=?", "secret")
+	rows, _ := d.Query("test", "select * from t")
+	for rows.Next() {
+	}
+	rows.Close()
+	d.Exec("test", "update t set name=? where id>?", "secret", 0)
+	d.Exec("test", "insert into nosuchtable values(1)")
+	log.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := []string{
+		"WRN db(test) QueryData slow, time:", "rows:1, sql:select * from t where name=?, args:1 redacted",
+		"WRN db(test) Query slow, time:", "rows:2, sql:select * from t",
+		"WRN db(test) Exec slow, time:", "rows:2, sql:update t set name=? where id>?, args:2 redacted",
+		"WRN db(test) Exec slow, time:", "rows:0, sql:insert into nosuchtable values(1), error:db(test) exec error:no such table",
+	}
+	if len(lines) != len(expected)/2 {
+		t.Fatalf("Unexpected slow log. Found %q, expected %d lines", lines, len(expected)/2)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[2*i]) || !strings.Contains(line, expected[2*i+1]) || strings.Contains(line, "secret") {
+			t.Fatalf("Unexpected slow log line. Found %q, expected %q ... %q", line, expected[2*i], expected[2*i+1])
+		}
+	}
+
+	buf.Reset()
+	item.SlowThreshold = 0
+	item.FastSampleRate = 1
+	d.QueryData("test", "select * from t")
+	log.Flush()
+	if !strings.HasPrefix(buf.String(), "INF db(test) QueryData sampled") {
+		t.Fatalf("Unexpected sampled slow log: %q", buf.String())
+	}
+}
+
+func TestTruncateSQL(t *testing.T) {
+	if s := truncateSQL("select 'ééé'", 10); s != "select 'é..." {
+		t.Fatalf("Unexpected truncated SQL: %q", s)
+	}
+	if s := truncateSQL("select 1", 10); s != "select 1" {
+		t.Fatalf("Unexpected truncated SQL: %q", s)
+	}
+}
+
+func TestSlowLogReplacedWhileQuerying(t *testing.T) {
+	defer log.ReplaceSlowLogger(nil)
+	d := newTestDatabase(t)
+	d.item("test").SlowThreshold = time.Nanosecond
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			captureSlowLog(t)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		d.Exec("test", "insert into t values(1, 'a')")
+	}
+	<-done
+}
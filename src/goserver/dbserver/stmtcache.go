@@ -0,0 +1,136 @@
+package dbserver
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+type stmtStats struct {
+	hits   int64
+	misses int64
+}
+
+/*
+stmtCache keeps the most recently used prepared statements of one db,
+keyed by SQL text. It belongs to a dbHandle, so a reconnect starts with
+an empty cache and the statements of the old db are closed with it.
+*/
+type stmtCache struct {
+	lock    sync.Mutex
+	size    int
+	lru     *list.List //of *stmtEntry, most recently used first
+	entries map[string]*list.Element
+	stats   *stmtStats
+}
+
+/*
+An evicted statement is closed when the last query using it is done.
+*/
+type stmtEntry struct {
+	query   string
+	stmt    *sql.Stmt
+	refs    int
+	evicted bool
+}
+
+func newStmtCache(size int, stats *stmtStats) *stmtCache {
+	return &stmtCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		stats:   stats,
+	}
+}
+
+/*
+get returns the statement of query, prepared on db if it is not cached.
+The entry must be released after use.
+*/
+func (c *stmtCache) get(ctx context.Context, db *sql.DB, query string) (*stmtEntry, error) {
+	c.lock.Lock()
+	if e, ok := c.entries[query]; ok {
+		c.lru.MoveToFront(e)
+		entry := e.Value.(*stmtEntry)
+		entry.refs++
+		c.lock.Unlock()
+		atomic.AddInt64(&c.stats.hits, 1)
+		return entry, nil
+	}
+	c.lock.Unlock()
+	atomic.AddInt64(&c.stats.misses, 1)
+
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[query]; ok {
+		//another query prepared it meanwhile
+		stmt.Close()
+		c.lru.MoveToFront(e)
+		entry := e.Value.(*stmtEntry)
+		entry.refs++
+		return entry, nil
+	}
+
+	entry := &stmtEntry{query: query, stmt: stmt, refs: 1}
+	c.entries[query] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Remove(c.lru.Back()).(*stmtEntry)
+		delete(c.entries, oldest.query)
+		oldest.evicted = true
+		if oldest.refs == 0 {
+			oldest.stmt.Close()
+		}
+	}
+	return entry, nil
+}
+
+func (c *stmtCache) release(entry *stmtEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry.refs--
+	if entry.evicted && entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+func (c *stmtCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+/*
+QueryContext and ExecContext make a dbHandle a queryer. Queries with args
+use the statement cache when the item has one, the others go to the db
+as they are, caching their literal SQL would only evict the useful ones.
+*/
+func (h *dbHandle) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if h.stmts == nil || len(args) == 0 {
+		return h.db.QueryContext(ctx, query, args...)
+	}
+	entry, err := h.stmts.get(ctx, h.db, query)
+	if err != nil {
+		return nil, err
+	}
+	defer h.stmts.release(entry)
+	return entry.stmt.QueryContext(ctx, args...)
+}
+
+func (h *dbHandle) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if h.stmts == nil || len(args) == 0 {
+		return h.db.ExecContext(ctx, query, args...)
+	}
+	entry, err := h.stmts.get(ctx, h.db, query)
+	if err != nil {
+		return nil, err
+	}
+	defer h.stmts.release(entry)
+	return entry.stmt.ExecContext(ctx, args...)
+}
@@ -0,0 +1,53 @@
+package dbserver
+
+import (
+	"testing"
+)
+
+func TestStmtCache(t *testing.T) {
+	d := newTestDatabase(t)
+	item := d.item("test")
+	item.StmtCacheSize = 2
+	d.connectItem(item)
+
+	assertCache := func(length int, hits, misses int64) {
+		s := item.status("test", item.primary)
+		if s.StmtCacheLen != length || s.StmtCacheHits != hits || s.StmtCacheMisses != misses {
+			t.Fatalf("Unexpected statement cache. Found len %d hits %d misses %d, expected %d %d %d",
+				s.StmtCacheLen, s.StmtCacheHits, s.StmtCacheMisses, length, hits, misses)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := d.Exec("test", "insert into t values(?, ?)", i, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCache(1, 2, 1)
+
+	//reads with args share the cache, reads without don't use it
+	if _, _, err := d.QueryData("test", "select * from t where id=?", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.QueryData("test", "select * from t"); err != nil {
+		t.Fatal(err)
+	}
+	assertCache(2, 2, 2)
+
+	//the least recently used statement is evicted, but a query still using it can finish
+	it, err := d.Iterate("test", "select * from t where id>?", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.QueryData("test", "select * from t where name=?", "a")
+	d.QueryData("test", "select * from t where id<?", 1)
+	assertCache(2, 2, 5)
+	for it.Next() {
+	}
+	if it.Err() != nil || it.Count() != 3 {
+		t.Fatalf("Unexpected iteration over an evicted statement. Found %d rows and error %v", it.Count(), it.Err())
+	}
+
+	d.connectItem(item)
+	assertCache(0, 2, 5)
+}
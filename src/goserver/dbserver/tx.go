@@ -0,0 +1,134 @@
+package dbserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"goserver/config"
+	"goserver/log"
+)
+
+/*
+Tx is the transaction handed to the function of WithTx. It has the same
+helpers as Database, without the dbname, and must not be used after the
+function returns.
+*/
+type Tx struct {
+	database *Database
+	dbname   string
+	item     *DBItem
+	tx       *sql.Tx
+	ctx      context.Context
+}
+
+func (tx *Tx) Query(sqlstr string, args ...interface{}) (*Rows, error) {
+	return tx.QueryContext(tx.ctx, sqlstr, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, sqlstr string, args ...interface{}) (*Rows, error) {
+	return tx.database.query(ctx, "Tx.Query", tx.dbname, tx.item, tx.tx, sqlstr, args...)
+}
+
+func (tx *Tx) QueryData(sqlstr string, args ...interface{}) (int, *[]map[string]interface{}, error) {
+	return tx.QueryDataContext(tx.ctx, sqlstr, args...)
+}
+
+func (tx *Tx) QueryDataContext(ctx context.Context, sqlstr string, args ...interface{}) (int, *[]map[string]interface{}, error) {
+	count, records, _, err := tx.database.queryData(ctx, "Tx.QueryData", tx.dbname, tx.item, tx.tx, false, sqlstr, args...)
+	return count, records, err
+}
+
+func (tx *Tx) QueryDataLenient(sqlstr string, args ...interface{}) (int, *[]map[string]interface{}, []*ScanError, error) {
+	return tx.QueryDataLenientContext(tx.ctx, sqlstr, args...)
+}
+
+func (tx *Tx) QueryDataLenientContext(ctx context.Context, sqlstr string, args ...interface{}) (int, *[]map[string]interface{}, []*ScanError, error) {
+	return tx.database.queryData(ctx, "Tx.QueryDataLenient", tx.dbname, tx.item, tx.tx, true, sqlstr, args...)
+}
+
+func (tx *Tx) QueryInto(dest interface{}, sqlstr string, args ...interface{}) (int, error) {
+	return tx.QueryIntoContext(tx.ctx, dest, sqlstr, args...)
+}
+
+func (tx *Tx) QueryIntoContext(ctx context.Context, dest interface{}, sqlstr string, args ...interface{}) (int, error) {
+	return tx.database.queryInto(ctx, "Tx.QueryInto", tx.dbname, tx.item, tx.tx, dest, sqlstr, args...)
+}
+
+func (tx *Tx) Iterate(sqlstr string, args ...interface{}) (*RowIterator, error) {
+	return tx.IterateContext(tx.ctx, sqlstr, args...)
+}
+
+func (tx *Tx) IterateContext(ctx context.Context, sqlstr string, args ...interface{}) (*RowIterator, error) {
+	return tx.database.iterate(ctx, "Tx.Iterate", tx.dbname, tx.item, tx.tx, sqlstr, args...)
+}
+
+func (tx *Tx) Exec(sqlstr string, args ...interface{}) (int64, int64, error) {
+	return tx.ExecContext(tx.ctx, sqlstr, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, sqlstr string, args ...interface{}) (int64, int64, error) {
+	return tx.database.exec(ctx, "Tx.Exec", tx.dbname, tx.item, tx.tx, sqlstr, args...)
+}
+
+/*
+WithTx runs fn in a transaction: it commits when fn returns nil and rolls
+back when fn returns an error or panics, the panic is raised again after
+the rollback. opts may be nil.
+*/
+func (database *Database) WithTx(dbname string, opts *sql.TxOptions, fn func(tx *Tx) error) error {
+	return database.WithTxContext(context.Background(), dbname, opts, fn)
+}
+
+/*
+The transaction is rolled back by database/sql if ctx is done before commit.
+*/
+func (database *Database) WithTxContext(ctx context.Context, dbname string, opts *sql.TxOptions, fn func(tx *Tx) error) error {
+	item, h, err := database.acquire(dbname)
+	if err != nil {
+		return err
+	}
+	defer h.release()
+
+	begintime := time.Now()
+	sqltx, err := h.db.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("db(%s) begin error:%s", dbname, config.RedactString(err.Error()))
+	}
+
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if err := sqltx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Errorf("db(%s) rollback error:%s", dbname, config.RedactString(err.Error()))
+		}
+		database.logTxTime(dbname, "rollback", begintime)
+	}()
+
+	tx := &Tx{
+		database: database,
+		dbname:   dbname,
+		item:     item,
+		tx:       sqltx,
+		ctx:      ctx,
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := sqltx.Commit(); err != nil {
+		return fmt.Errorf("db(%s) commit error:%s", dbname, config.RedactString(err.Error()))
+	}
+	committed = true
+	database.logTxTime(dbname, "commit", begintime)
+	return nil
+}
+
+func (database *Database) logTxTime(dbname, result string, begintime time.Time) {
+	if database.logSQLExecuteTime() {
+		log.Infof("Tx(%s) %s, time:%v", dbname, result, time.Now().Sub(begintime))
+	}
+}
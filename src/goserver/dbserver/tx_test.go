@@ -0,0 +1,66 @@
+package dbserver
+
+import (
+	"errors"
+	"testing"
+)
+
+func countRows(t *testing.T, d *Database) int64 {
+	_, records, err := d.QueryData("test", "select count(*) as n from t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return (*records)[0]["n"].(int64)
+}
+
+func TestWithTxCommit(t *testing.T) {
+	d := newTestDatabase(t)
+	err := d.WithTx("test", nil, func(tx *Tx) error {
+		_, _, err := tx.Exec("insert into t values(1, 'a'), (2, 'b')")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, d); n != 2 {
+		t.Fatalf("Unexpected rows after commit. Found %d, expected 2", n)
+	}
+}
+
+func TestWithTxRollbackOnError(t *testing.T) {
+	d := newTestDatabase(t)
+	fail := errors.New("fail")
+	err := d.WithTx("test", nil, func(tx *Tx) error {
+		if _, _, err := tx.Exec("insert into t values(1, 'a')"); err != nil {
+			t.Fatal(err)
+		}
+		return fail
+	})
+	if err != fail {
+		t.Fatalf("Unexpected error. Found %v, expected %v", err, fail)
+	}
+	if n := countRows(t, d); n != 0 {
+		t.Fatalf("Unexpected rows after rollback. Found %d, expected 0", n)
+	}
+}
+
+func TestWithTxRollbackOnPanic(t *testing.T) {
+	d := newTestDatabase(t)
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("Unexpected panic. Found %v, expected boom", r)
+			}
+		}()
+		d.WithTx("test", nil, func(tx *Tx) error {
+			if _, _, err := tx.Exec("insert into t values(1, 'a')"); err != nil {
+				t.Fatal(err)
+			}
+			panic("boom")
+		})
+		t.Fatal("WithTx returned after a panic")
+	}()
+	if n := countRows(t, d); n != 0 {
+		t.Fatalf("Unexpected rows after rollback. Found %d, expected 0", n)
+	}
+}
@@ -9,10 +9,17 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 	//"syscall"
 )
 
+var startTime = time.Now()
+
 var signalHandlerMap map[os.Signal]func()
+var signalLoopRunning int32
+var handlerStarted int64 //unix nano the running handler started at, 0:none running
+var handlerTimeout = int64(time.Minute)
 
 func PidFileName() string {
 	file, _ := exec.LookPath(os.Args[0])
@@ -68,11 +75,43 @@ func Run() {
 		signals = append(signals, k)
 	}
 	gosignal.Notify(signalChan, signals...)
+	atomic.StoreInt32(&signalLoopRunning, 1)
 	go func() {
+		defer atomic.StoreInt32(&signalLoopRunning, 0)
 		for sig := range signalChan {
 			if signalHandlerMap[sig] != nil {
+				atomic.StoreInt64(&handlerStarted, time.Now().UnixNano())
 				signalHandlerMap[sig]()
+				atomic.StoreInt64(&handlerStarted, 0)
 			}
 		}
 	}()
 }
+
+/*
+SetHandlerTimeout sets how long a signal handler may run before the loop
+counts as stuck, one minute by default.
+*/
+func SetHandlerTimeout(d time.Duration) {
+	atomic.StoreInt64(&handlerTimeout, int64(d))
+}
+
+/*
+SignalLoopRunning reports whether signals are still handled: the loop is
+started and no handler, like a reload, has been running for longer than
+the handler timeout. Shutdown is a handler too, it is given its time.
+*/
+func SignalLoopRunning() bool {
+	if atomic.LoadInt32(&signalLoopRunning) != 1 {
+		return false
+	}
+	started := atomic.LoadInt64(&handlerStarted)
+	if started == 0 || ShuttingDown() {
+		return true
+	}
+	return time.Now().Sub(time.Unix(0, started)) <= time.Duration(atomic.LoadInt64(&handlerTimeout))
+}
+
+func StartTime() time.Time {
+	return startTime
+}
@@ -0,0 +1,64 @@
+package goserver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goserver/log"
+)
+
+type shutdownHook struct {
+	name string
+	hook func(ctx context.Context) error
+}
+
+var shutdownHooks []shutdownHook
+var shutdownOnce sync.Once
+var shuttingDown int32
+
+/*
+Hooks run in the order they are added and share one deadline,
+so add the listeners first and the databases after them.
+*/
+func AddShutdownHook(name string, hook func(ctx context.Context) error) {
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, hook: hook})
+}
+
+/*
+Shutdown fails readiness, waits delay so load balancers see /readyz
+fail and stop sending requests, then runs every hook, flushes the log
+and removes the pid file. timeout only bounds the hooks.
+It only does the work once, later calls return immediately.
+*/
+func Shutdown(delay, timeout time.Duration) {
+	shutdownOnce.Do(func() {
+		atomic.StoreInt32(&shuttingDown, 1)
+		log.Infof("shutdown begin, delay:%v, timeout:%v", delay, timeout)
+		time.Sleep(delay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		for _, h := range shutdownHooks {
+			begintime := time.Now()
+			if err := h.hook(ctx); err != nil {
+				log.Errorf("shutdown %s error:%s", h.name, err.Error())
+				continue
+			}
+			log.Infof("shutdown %s, time:%v", h.name, time.Now().Sub(begintime))
+		}
+
+		log.Infof("shutdown end")
+		log.Flush()
+		RemovePidFile()
+	})
+}
+
+/*
+ShuttingDown is true from the start of Shutdown, before any hook runs.
+*/
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
@@ -0,0 +1,103 @@
+package httpserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+
+	"goserver/config"
+	"goserver/log"
+)
+
+/*
+The admin listener serves the operational routes, apart from the
+application routes of the httpserver listener. The credentials are read
+on every request, so a reload changes them without a rebind, see Reload.
+*/
+var admin = &listener{name: "admin"}
+var adminConfig atomic.Value //config.AdminConfig
+
+func InitAdminRouter() *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.Default()
+	router.Use(adminAuth)
+	router.NoRoute(requestMetrics("unmatched"))
+	get(router, "/serverinfo", getServerInfo)
+	get(router, "/serverstats", getServerStats)
+	get(router, "/serverconfig", getServerConfig)
+	get(router, "/testexec", getTestExec)
+	router.GET("/debug/pprof/*name", requestMetrics("/debug/pprof"), getPprof)
+	router.POST("/debug/pprof/*name", requestMetrics("/debug/pprof"), getPprof)
+	return router
+}
+
+func setAdminConfig(c config.AdminConfig) {
+	adminConfig.Store(c)
+}
+
+/*
+adminAuth accepts "Authorization: Bearer <token>" when admin.token is set
+and basic auth when admin.user is set. With neither every request is
+refused, the admin routes are never open.
+*/
+func adminAuth(c *gin.Context) {
+	ac, _ := adminConfig.Load().(config.AdminConfig)
+	auth := c.Request.Header.Get("Authorization")
+	if ac.Token != "" && strings.HasPrefix(auth, "Bearer ") && secureEqual(strings.TrimPrefix(auth, "Bearer "), ac.Token) {
+		c.Next()
+		return
+	}
+	if ac.User != "" {
+		if user, password, ok := c.Request.BasicAuth(); ok && secureEqual(user, ac.User) && secureEqual(password, ac.Password) {
+			c.Next()
+			return
+		}
+		c.Header("WWW-Authenticate", `Basic realm="goserver admin"`)
+	}
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+/*
+getPprof serves net/http/pprof, only when admin.pprof is on.
+*/
+func getPprof(c *gin.Context) {
+	if ac, _ := adminConfig.Load().(config.AdminConfig); ac.Pprof != "on" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	switch c.Param("name") {
+	case "/cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "/profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "/symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "/trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+func runAdmin(c *config.Config) {
+	if c.Admin.Switch != "on" {
+		return
+	}
+	setAdminConfig(c.Admin)
+	if err := admin.start(adminAddr(c), InitAdminRouter(), drainTimeout(c), nil); err != nil {
+		log.Errorf("%s", err.Error())
+	}
+}
+
+func adminAddr(c *config.Config) string {
+	return fmt.Sprintf("%s:%d", c.Admin.Ip, c.Admin.Port)
+}
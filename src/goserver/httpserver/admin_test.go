@@ -0,0 +1,129 @@
+package httpserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"goserver/config"
+)
+
+const testAdminToken = "t0ken"
+
+/*
+serveAdmin sends a GET with the admin token of the tests.
+*/
+func serveAdmin(path, accept string) *httptest.ResponseRecorder {
+	setAdminConfig(config.AdminConfig{Token: testAdminToken, User: "admin", Password: "pw", Pprof: "on"})
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	InitAdminRouter().ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	setAdminConfig(config.AdminConfig{Token: testAdminToken, User: "admin", Password: "pw"})
+	router := InitAdminRouter()
+
+	for _, tc := range []struct {
+		auth func(r *http.Request)
+		code int
+	}{
+		{func(r *http.Request) {}, http.StatusUnauthorized},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+testAdminToken) }, http.StatusOK},
+		{func(r *http.Request) { r.SetBasicAuth("admin", "pw") }, http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/serverconfig", nil)
+		tc.auth(r)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Fatalf("Unexpected status for %q. Found %d, expected %d", r.Header.Get("Authorization"), w.Code, tc.code)
+		}
+	}
+
+	//no credentials configured: nothing is served
+	setAdminConfig(config.AdminConfig{})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/serverconfig", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Unexpected status without credentials: %d", w.Code)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	if w := serveAdmin("/debug/pprof/cmdline", ""); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected pprof status: %d", w.Code)
+	}
+	setAdminConfig(config.AdminConfig{Token: testAdminToken})
+	r := httptest.NewRequest("GET", "/debug/pprof/cmdline", nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	InitAdminRouter().ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Unexpected pprof status with admin.pprof off: %d", w.Code)
+	}
+
+	//the public listener only has the application routes and /metrics
+	for _, path := range []string{"/serverconfig", "/testexec", "/debug/pprof/"} {
+		w := httptest.NewRecorder()
+		InitRouter().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("Unexpected public status of %s: %d", path, w.Code)
+		}
+	}
+}
+
+/*
+A reload whose admin address can't be bound must not move the httpserver
+listener either.
+*/
+func TestReloadAdminBindFails(t *testing.T) {
+	c := config.DefaultConfig()
+	c.HttpServer.Ip = "127.0.0.1"
+	c.HttpServer.Port = freePort(t)
+	c.Shutdown.Timeout = 1
+	Run(c)
+	defer Shutdown(context.Background())
+	running := listenAddr(c)
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	n := *c
+	n.HttpServer.Port = freePort(t)
+	n.Admin.Switch = "on"
+	n.Admin.Ip = "127.0.0.1"
+	n.Admin.Port = uint16(busy.Addr().(*net.TCPAddr).Port)
+	n.Admin.Token = testAdminToken
+	if err := Reload(&n); err == nil {
+		t.Fatal("Expected a reload with a busy admin port to fail")
+	}
+	if addr := server.addr(); addr != running {
+		t.Fatalf("Unexpected httpserver address after a rejected reload. Found %s, expected %s", addr, running)
+	}
+	if admin.addr() != "" {
+		t.Fatalf("Unexpected admin listener after a rejected reload: %s", admin.addr())
+	}
+	ln, err := net.Listen("tcp", listenAddr(&n))
+	if err != nil {
+		t.Fatalf("New httpserver address still bound after a rejected reload: %v", err)
+	}
+	ln.Close()
+	resp, err := http.Get("http://" + running + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
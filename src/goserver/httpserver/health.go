@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goserver/dbserver"
+	"goserver/goserver"
+)
+
+const (
+	checkOK   = "ok"
+	checkFail = "fail"
+)
+
+/*
+check is one line of the /healthz and /readyz detail. A check that is
+not required is reported but doesn't change the status.
+*/
+type check struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Required bool   `json:"required"`
+	State    string `json:"state,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string  `json:"status"`
+	Checks []check `json:"checks"`
+}
+
+func newCheck(name string, ok bool, required bool) check {
+	c := check{Name: name, Status: checkOK, Required: required}
+	if !ok {
+		c.Status = checkFail
+	}
+	return c
+}
+
+/*
+writeHealth answers 200 when every required check is ok, 503 otherwise.
+*/
+func writeHealth(c *gin.Context, checks []check) {
+	resp := healthResponse{Status: checkOK, Checks: checks}
+	code := http.StatusOK
+	for _, ch := range checks {
+		if ch.Required && ch.Status != checkOK {
+			resp.Status = checkFail
+			code = http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(code, resp)
+}
+
+/*
+getHealthz is the liveness check: the process answers and still handles
+its signals.
+*/
+func getHealthz(c *gin.Context) {
+	writeHealth(c, []check{newCheck("signal_loop", goserver.SignalLoopRunning(), true)})
+}
+
+/*
+getReadyz is the readiness check: not shutting down and every required
+dbitem connected. Replicas and dbitems with Required off are listed but
+optional.
+*/
+func getReadyz(c *gin.Context) {
+	checks := []check{newCheck("shutdown", !goserver.ShuttingDown(), true)}
+	for _, s := range dbserver.Statuses() {
+		ch := newCheck("db("+s.DBName+")", s.Connected == 1, s.Required)
+		if s.Role != "primary" {
+			ch.Name = "db(" + s.DBName + "/" + s.Role + ")"
+		}
+		ch.State = s.State
+		ch.Error = s.LastError
+		checks = append(checks, ch)
+	}
+	writeHealth(c, checks)
+}
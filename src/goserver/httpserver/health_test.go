@@ -0,0 +1,128 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"goserver/config"
+	"goserver/dbserver"
+	"goserver/goserver"
+)
+
+func getHealth(t *testing.T, path string) (int, healthResponse) {
+	w := httptest.NewRecorder()
+	InitRouter().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var resp healthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Unexpected %s body %q: %v", path, w.Body.String(), err)
+	}
+	return w.Code, resp
+}
+
+func TestReadyz(t *testing.T) {
+	c := &config.Config{}
+	c.DBServer.Switch = "on"
+	c.DBServer.DBItems = []config.DBItemConfig{
+		{DBName: "required", DriverName: "sqlite3", DataSourceName: "file:readyz?mode=memory&cache=shared", MaxOpenConns: 1},
+		{DBName: "optional", DriverName: "sqlite3", DataSourceName: "/nosuchdir/optional.db", Required: "off"},
+	}
+	dbserver.Run(c)
+	defer func() {
+		dbserver.GetDatabase().DelItem("required")
+		dbserver.GetDatabase().DelItem("optional")
+	}()
+
+	code, resp := getHealth(t, "/readyz")
+	if code != http.StatusOK || resp.Status != checkOK || len(resp.Checks) != 3 {
+		t.Fatalf("Unexpected readiness: %d %+v", code, resp)
+	}
+	if ch := resp.Checks[1]; ch.Name != "db(optional)" || ch.Status != checkFail || ch.Required || ch.Error == "" {
+		t.Fatalf("Unexpected optional db check: %+v", ch)
+	}
+
+	dbserver.GetDatabase().DelItem("required")
+	c.DBServer.DBItems[0].DataSourceName = "/nosuchdir/required.db"
+	dbserver.Reload(c, &config.ConfigDiff{DBItemsAdded: c.DBServer.DBItems[:1]})
+	if code, resp := getHealth(t, "/readyz"); code != http.StatusServiceUnavailable || resp.Status != checkFail {
+		t.Fatalf("Unexpected readiness without the required db: %d %+v", code, resp)
+	}
+}
+
+/*
+TestStuckSignalHandler runs before TestShutdownFailsReadiness, a handler
+is given its time once shutdown began.
+*/
+func TestStuckSignalHandler(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	goserver.SetSignalHandler(func() {
+		close(started)
+		<-release
+	}, syscall.SIGUSR2)
+	goserver.SetHandlerTimeout(time.Millisecond * 50)
+	defer goserver.SetHandlerTimeout(time.Minute)
+	if code, _ := getHealth(t, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("Unexpected liveness before the signal loop runs: %d", code)
+	}
+	goserver.Run()
+	defer goserver.RemovePidFile()
+
+	if code, resp := getHealth(t, "/healthz"); code != http.StatusOK {
+		t.Fatalf("Unexpected liveness: %d %+v", code, resp)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	<-started
+	time.Sleep(time.Millisecond * 100)
+	if code, resp := getHealth(t, "/healthz"); code != http.StatusServiceUnavailable || resp.Checks[0].Name != "signal_loop" {
+		t.Fatalf("Unexpected liveness with a stuck handler: %d %+v", code, resp)
+	}
+
+	close(release)
+	for i := 0; ; i++ {
+		if code, _ := getHealth(t, "/healthz"); code == http.StatusOK {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Liveness didn't recover once the handler returned")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestShutdownFailsReadiness(t *testing.T) {
+	if code, _ := getHealth(t, "/readyz"); code != http.StatusOK {
+		t.Fatalf("Unexpected readiness before shutdown: %d", code)
+	}
+	var hookRan int32
+	goserver.AddShutdownHook("test", func(ctx context.Context) error {
+		atomic.StoreInt32(&hookRan, 1)
+		return nil
+	})
+	done := make(chan struct{})
+	go func() {
+		goserver.Shutdown(time.Millisecond*200, time.Second)
+		close(done)
+	}()
+	for !goserver.ShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+
+	//the listeners still serve during the delay, only readiness fails
+	code, resp := getHealth(t, "/readyz")
+	if code != http.StatusServiceUnavailable || resp.Checks[0].Name != "shutdown" || resp.Checks[0].Status != checkFail {
+		t.Fatalf("Unexpected readiness during shutdown: %d %+v", code, resp)
+	}
+	if atomic.LoadInt32(&hookRan) != 0 {
+		t.Fatal("Unexpected shutdown hook run before the delay")
+	}
+	<-done
+	if atomic.LoadInt32(&hookRan) != 1 {
+		t.Fatal("Shutdown hook didn't run")
+	}
+}
@@ -1,13 +1,15 @@
 package httpserver
 
 import (
+	"context"
+	"crypto/tls"
 	//"encoding/json"
 	"fmt"
 	//"io"
 	//"io/ioutil"
 	//"net"
 	"net/http"
-	_ "net/http/pprof"
+	"time"
 
 	//"github.com/golang/net/netutil"
 	//"github.com/gorilla/mux"
@@ -17,38 +19,40 @@ import (
 
 	"goserver/config"
 	"goserver/dbserver"
-	//"goserver/log"
+	"goserver/log"
 	//"goserver/pkg/version"
 )
 
 //var middleware *stats.Stats
 
+var server = &listener{name: "httpserver"}
+
 func InitRouter() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
-	router.GET("/serverinfo", getServerInfo)
-	router.GET("/serverstats", getServerStats)
-	router.GET("/serverconfig", getServerConfig)
-	router.GET("/testquery", getTestQuery)
-	router.GET("/testexec", getTestExec)
+	router.NoRoute(requestMetrics("unmatched"))
+	get(router, "/testquery", getTestQuery)
+	get(router, "/healthz", getHealthz)
+	get(router, "/readyz", getReadyz)
+	get(router, "/metrics", getMetrics)
 	return router
 }
 
-func getServerInfo(c *gin.Context) {
-	c.String(http.StatusOK, dbserver.Status())
-}
-
-func getServerStats(c *gin.Context) {
-	c.String(http.StatusOK, dbserver.Status())
-}
-
 func getServerConfig(c *gin.Context) {
-	c.String(http.StatusOK, fmt.Sprintf("%s", config.ConfigJson()))
+	if c.Query("origin") != "" {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(config.ConfigOriginJson()))
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(config.ConfigJson()))
 }
 
 func getTestQuery(c *gin.Context) {
 	db := dbserver.GetDatabase()
-	_, rows, _ := db.QueryData("mysql1", "select * from test where id=5")
+	_, rows, err := db.QueryDataContext(c.Request.Context(), "mysql1", "select * from test where id=?", c.DefaultQuery("id", "5"))
+	if err != nil {
+		c.String(http.StatusOK, fmt.Sprintf("error:%s", err.Error()))
+		return
+	}
 	result := ""
 	for row := range *rows {
 		for k, v := range (*rows)[row] {
@@ -58,10 +62,10 @@ func getTestQuery(c *gin.Context) {
 			}
 			switch k {
 			case "id":
-				result = result + fmt.Sprintf("%s:%s;", k, string(v.([]byte)))
+				result = result + fmt.Sprintf("%s:%d;", k, v)
 				break
 			case "name":
-				result = result + fmt.Sprintf("%s:%s;", k, string(v.([]byte)))
+				result = result + fmt.Sprintf("%s:%s;", k, v)
 				break
 			}
 		}
@@ -72,7 +76,7 @@ func getTestQuery(c *gin.Context) {
 
 func getTestExec(c *gin.Context) {
 	db := dbserver.GetDatabase()
-	lastid, affectrow, err := db.Exec("mysql1", "insert into test(id,name) values (?,?)", 3, "123")
+	lastid, affectrow, err := db.ExecContext(c.Request.Context(), "mysql1", "insert into test(id,name) values (?,?)", 3, "123")
 	if err != nil {
 		c.String(http.StatusOK, fmt.Sprintf("lastid:%d, affectrow:%d, error:%s", lastid, affectrow, err.Error()))
 	} else {
@@ -81,7 +85,12 @@ func getTestExec(c *gin.Context) {
 
 }
 
+/*
+Run starts the httpserver listener and the admin listener, each when
+its switch is on.
+*/
 func Run(c *config.Config) {
+	runAdmin(c)
 	if c.HttpServer.Switch != "on" {
 		return
 	}
@@ -89,7 +98,65 @@ func Run(c *config.Config) {
 	//iris.UseFunc()
 	//middleware = stats.New()
 	//iris.Use(stats)
-	router := InitRouter()
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		log.Errorf("%s", err.Error())
+		return
+	}
+	if err := server.start(listenAddr(c), InitRouter(), drainTimeout(c), tlsConfig); err != nil {
+		log.Errorf("%s", err.Error())
+	}
+}
+
+/*
+Reload applies the httpserver and admin sections. A listener is rebound
+when its ip/port changed or TLS was switched on or off, otherwise the
+certificate files are read again and the TLS settings swapped without
+dropping it. New addresses are bound and certificates read for both
+listeners before either is changed, so a failure leaves both untouched.
+*/
+func Reload(c *config.Config) error {
+	var tlsConfig *tls.Config
+	if c.HttpServer.Switch == "on" {
+		var err error
+		if tlsConfig, err = newTLSConfig(c); err != nil {
+			return err
+		}
+	}
+	public, err := server.prepare(c.HttpServer.Switch == "on", listenAddr(c), InitRouter(), drainTimeout(c), tlsConfig)
+	if err != nil {
+		return err
+	}
+	adminChange, err := admin.prepare(c.Admin.Switch == "on", adminAddr(c), InitAdminRouter(), drainTimeout(c), nil)
+	if err != nil {
+		public.cancel()
+		return err
+	}
+
+	setAdminConfig(c.Admin)
+	err = public.apply()
+	if adminErr := adminChange.apply(); err == nil {
+		err = adminErr
+	}
+	return err
+}
+
+/*
+Shutdown stops accepting new connections and waits for in-flight requests
+until ctx is done, on the httpserver listener first.
+*/
+func Shutdown(ctx context.Context) error {
+	err := server.stop(ctx)
+	if adminErr := admin.stop(ctx); err == nil {
+		err = adminErr
+	}
+	return err
+}
+
+func listenAddr(c *config.Config) string {
+	return fmt.Sprintf("%s:%d", c.HttpServer.Ip, c.HttpServer.Port)
+}
 
-	go router.Run(fmt.Sprintf(":%d", c.HttpServer.Port))
+func drainTimeout(c *config.Config) time.Duration {
+	return time.Duration(c.Shutdown.Timeout) * time.Second
 }
@@ -0,0 +1,231 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goserver/log"
+)
+
+/*
+listener owns one http.Server and can move it to a new address without
+dropping the requests the old server is still serving.
+A TLS server takes its certificates and settings from tlsConfig on every
+handshake, so they can be swapped without a rebind.
+*/
+type listener struct {
+	name      string
+	lock      sync.Mutex
+	server    *http.Server
+	ln        net.Listener
+	tls       bool
+	tlsConfig atomic.Value //*tls.Config
+}
+
+func (l *listener) addr() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.server == nil {
+		return ""
+	}
+	return l.server.Addr
+}
+
+func (l *listener) isTLS() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.tls
+}
+
+/*
+start binds addr before touching the running server, so a failed bind
+leaves the old one serving. The replaced server is drained in background.
+When only TLS is switched on or off the address is the same, the old
+socket is closed first to free it, its connections are still drained;
+a failed bind then leaves nothing listening until the next reload.
+tlsConfig nil serves plain http.
+*/
+func (l *listener) start(addr string, handler http.Handler, drainTimeout time.Duration, tlsConfig *tls.Config) error {
+	l.lock.Lock()
+	if l.server != nil && l.server.Addr == addr {
+		l.ln.Close()
+	}
+	l.lock.Unlock()
+
+	ln, err := l.listen(addr)
+	if err != nil {
+		return err
+	}
+	l.serve(ln, addr, handler, drainTimeout, tlsConfig)
+	return nil
+}
+
+func (l *listener) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s listen(%s) error:%s", l.name, addr, err.Error())
+	}
+	return ln, nil
+}
+
+/*
+serve replaces the running server by one serving on ln.
+*/
+func (l *listener) serve(ln net.Listener, addr string, handler http.Handler, drainTimeout time.Duration, tlsConfig *tls.Config) {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+	if tlsConfig != nil {
+		l.tlsConfig.Store(tlsConfig)
+		srv.TLSConfig = &tls.Config{
+			GetCertificate:     l.getCertificate,
+			GetConfigForClient: l.getConfigForClient,
+		}
+	}
+
+	l.lock.Lock()
+	old := l.server
+	l.server = srv
+	l.ln = ln
+	l.tls = tlsConfig != nil
+	l.lock.Unlock()
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed && l.current(srv) {
+			log.Errorf("%s serve(%s) error:%s", l.name, addr, err.Error())
+		}
+	}()
+	if tlsConfig != nil {
+		log.Infof("%s listen on %s, tls", l.name, addr)
+	} else {
+		log.Infof("%s listen on %s", l.name, addr)
+	}
+
+	if old != nil {
+		go l.drain(old, drainTimeout)
+	}
+}
+
+/*
+change is a checked listener change that is not applied yet. A new
+address is already bound, so applying it only fails for a TLS switch on
+the same address, see start. cancel releases what prepare took.
+*/
+type change struct {
+	l            *listener
+	off          bool
+	addr         string
+	handler      http.Handler
+	drainTimeout time.Duration
+	tlsConfig    *tls.Config
+	ln           net.Listener //bound new address, nil:none
+	rebind       bool         //TLS switched on the same address
+}
+
+/*
+prepare checks what moving the listener to addr and tlsConfig takes,
+binding a new address right away. on false stops the listener.
+*/
+func (l *listener) prepare(on bool, addr string, handler http.Handler, drainTimeout time.Duration, tlsConfig *tls.Config) (*change, error) {
+	ch := &change{l: l, off: !on, addr: addr, handler: handler, drainTimeout: drainTimeout, tlsConfig: tlsConfig}
+	if !on {
+		return ch, nil
+	}
+	switch {
+	case l.addr() != addr:
+		ln, err := l.listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		ch.ln = ln
+	case l.isTLS() != (tlsConfig != nil):
+		ch.rebind = true
+	}
+	return ch, nil
+}
+
+func (ch *change) apply() error {
+	switch {
+	case ch.off:
+		ctx, cancel := context.WithTimeout(context.Background(), ch.drainTimeout)
+		defer cancel()
+		return ch.l.stop(ctx)
+	case ch.ln != nil:
+		ch.l.serve(ch.ln, ch.addr, ch.handler, ch.drainTimeout, ch.tlsConfig)
+	case ch.rebind:
+		return ch.l.start(ch.addr, ch.handler, ch.drainTimeout, ch.tlsConfig)
+	case ch.tlsConfig != nil:
+		ch.l.setTLSConfig(ch.tlsConfig)
+		log.Infof("%s tls config reloaded", ch.l.name)
+	}
+	return nil
+}
+
+func (ch *change) cancel() {
+	if ch.ln != nil {
+		ch.ln.Close()
+	}
+}
+
+func (l *listener) current(srv *http.Server) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.server == srv
+}
+
+/*
+setTLSConfig swaps the settings of the running TLS server, the next
+handshakes use them.
+*/
+func (l *listener) setTLSConfig(tlsConfig *tls.Config) {
+	l.tlsConfig.Store(tlsConfig)
+}
+
+func (l *listener) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return l.tlsConfig.Load().(*tls.Config), nil
+}
+
+func (l *listener) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &l.tlsConfig.Load().(*tls.Config).Certificates[0], nil
+}
+
+func (l *listener) drain(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("%s drain(%s) error:%s", l.name, srv.Addr, err.Error())
+		return
+	}
+	log.Infof("%s drained %s", l.name, srv.Addr)
+}
+
+/*
+stop stops accepting new connections and waits for in-flight requests
+until ctx is done.
+*/
+func (l *listener) stop(ctx context.Context) error {
+	l.lock.Lock()
+	srv := l.server
+	l.server = nil
+	l.ln = nil
+	l.tls = false
+	l.lock.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
@@ -0,0 +1,78 @@
+package httpserver
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goserver/log"
+	"goserver/metrics"
+	"goserver/pkg/version"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("goserver_http_requests_total",
+		"HTTP requests by route, method and status code.",
+		"route", "method", "code")
+	requestDuration = metrics.NewHistogramVec("goserver_http_request_duration_seconds",
+		"Time to serve an HTTP request by route and method.",
+		metrics.DefBuckets, "route", "method")
+)
+
+func init() {
+	metrics.Register(metrics.CollectorFunc(collectBuildInfo))
+}
+
+func collectBuildInfo() []metrics.Family {
+	return []metrics.Family{{
+		Name:       "goserver_build_info",
+		Help:       "Version of goserver, set at build time, the value is always 1.",
+		Type:       metrics.TypeGauge,
+		LabelNames: []string{"version", "commit", "build_date", "goversion"},
+		Metrics: []metrics.Metric{{
+			LabelValues: []string{version.GitVersion, version.GitCommit, version.BuildDate, runtime.Version()},
+			Value:       1,
+		}},
+	}}
+}
+
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "PATCH": true, "OPTIONS": true,
+}
+
+/*
+requestMetrics counts the requests of one route. It takes the route
+pattern rather than the request path, unmatched paths are all counted
+as one route and unknown methods as "other", so a scan can't make up
+new series.
+*/
+func requestMetrics(route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		begintime := time.Now()
+		c.Next()
+		method := c.Request.Method
+		if !knownMethods[method] {
+			method = "other"
+		}
+		requestsTotal.With(route, method, strconv.Itoa(c.Writer.Status())).Inc()
+		requestDuration.With(route, method).Observe(time.Now().Sub(begintime).Seconds())
+	}
+}
+
+/*
+get registers a GET route with its request metrics.
+*/
+func get(router *gin.Engine, route string, handler gin.HandlerFunc) {
+	router.GET(route, requestMetrics(route), handler)
+}
+
+func getMetrics(c *gin.Context) {
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", metrics.ContentType)
+	if err := metrics.WriteText(c.Writer, metrics.Gather()); err != nil {
+		log.Errorf("httpserver metrics error:%s", err.Error())
+	}
+}
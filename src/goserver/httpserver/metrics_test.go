@@ -0,0 +1,58 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"goserver/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	router := InitRouter()
+	unmatched := requestsTotal.With("unmatched", "GET", "404").Value()
+	for _, path := range []string{"/testquery", "/nosuchpath", "/nosuchpath2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	if n := requestsTotal.With("unmatched", "GET", "404").Value() - unmatched; n != 2 {
+		t.Fatalf("Unexpected unmatched requests. Found %v, expected 2", n)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != metrics.ContentType {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE goserver_http_requests_total counter\n",
+		`goserver_http_requests_total{route="/testquery",method="GET",code="200"} 1` + "\n",
+		`goserver_http_request_duration_seconds_bucket{route="/testquery",method="GET",le="+Inf"} 1` + "\n",
+		`goserver_http_requests_total{route="unmatched",method="GET",code="404"} `,
+		`goserver_build_info{version="unknown",commit="unknown",build_date="unknown",goversion="`,
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("Missing %q in metrics:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsUnknownMethod(t *testing.T) {
+	router := InitRouter()
+	other := requestsTotal.With("unmatched", "other", "404").Value()
+	for _, method := range []string{"FOO", "BAR1", "BAR2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/nosuchpath", nil))
+	}
+	if n := requestsTotal.With("unmatched", "other", "404").Value() - other; n != 3 {
+		t.Fatalf("Unexpected requests with an unknown method. Found %v, expected 3", n)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if body := w.Body.String(); strings.Contains(body, `method="FOO"`) || strings.Contains(body, `method="BAR1"`) {
+		t.Fatalf("Unexpected series of a made-up method in metrics:\n%s", body)
+	}
+}
@@ -0,0 +1,135 @@
+package httpserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goserver/config"
+	"goserver/dbserver"
+	"goserver/goserver"
+	"goserver/pkg/version"
+)
+
+type serverInfo struct {
+	Version    string    `json:"version"`
+	Commit     string    `json:"commit"`
+	BuildDate  string    `json:"build_date"`
+	GoVersion  string    `json:"go_version"`
+	Pid        int       `json:"pid"`
+	StartTime  time.Time `json:"start_time"`
+	Uptime     string    `json:"uptime"`
+	Hostname   string    `json:"hostname"`
+	ConfigFile string    `json:"config_file"`
+}
+
+type runtimeStats struct {
+	Goroutines   int     `json:"goroutines"`
+	NumCPU       int     `json:"num_cpu"`
+	GOMAXPROCS   int     `json:"gomaxprocs"`
+	Alloc        uint64  `json:"alloc_bytes"`
+	TotalAlloc   uint64  `json:"total_alloc_bytes"`
+	Sys          uint64  `json:"sys_bytes"`
+	HeapObjects  uint64  `json:"heap_objects"`
+	NumGC        uint32  `json:"num_gc"`
+	PauseTotalMs float64 `json:"gc_pause_total_ms"`
+}
+
+type httpServerStats struct {
+	Addr string `json:"addr"`
+}
+
+type serverStats struct {
+	Uptime     string                `json:"uptime"`
+	Runtime    runtimeStats          `json:"runtime"`
+	HttpServer httpServerStats       `json:"httpserver"`
+	DBServer   []dbserver.ItemStatus `json:"dbserver"`
+}
+
+/*
+wantsText picks the response format from the Accept header: the first of
+text/plain and application/json listed wins, JSON when neither is.
+*/
+func wantsText(c *gin.Context) bool {
+	for _, part := range strings.Split(c.Request.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		switch mediaType {
+		case "text/plain":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+func uptime() string {
+	return time.Now().Sub(goserver.StartTime()).Truncate(time.Second).String()
+}
+
+func getServerInfo(c *gin.Context) {
+	hostname, _ := os.Hostname()
+	info := serverInfo{
+		Version:    version.GitVersion,
+		Commit:     version.GitCommit,
+		BuildDate:  version.BuildDate,
+		GoVersion:  runtime.Version(),
+		Pid:        os.Getpid(),
+		StartTime:  goserver.StartTime(),
+		Uptime:     uptime(),
+		Hostname:   hostname,
+		ConfigFile: config.ConfigPath(),
+	}
+	if !wantsText(c) {
+		c.JSON(http.StatusOK, info)
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Version\t%s\n", info.Version)
+	fmt.Fprintf(&buf, "Commit\t%s\n", info.Commit)
+	fmt.Fprintf(&buf, "BuildDate\t%s\n", info.BuildDate)
+	fmt.Fprintf(&buf, "GoVersion\t%s\n", info.GoVersion)
+	fmt.Fprintf(&buf, "Pid\t%d\n", info.Pid)
+	fmt.Fprintf(&buf, "StartTime\t%s\n", info.StartTime.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&buf, "Uptime\t%s\n", info.Uptime)
+	fmt.Fprintf(&buf, "Hostname\t%s\n", info.Hostname)
+	fmt.Fprintf(&buf, "ConfigFile\t%s\n", info.ConfigFile)
+	c.String(http.StatusOK, buf.String())
+}
+
+/*
+getServerStats falls back to the tab separated dbserver.Status() for
+text/plain, the format it always had.
+*/
+func getServerStats(c *gin.Context) {
+	if wantsText(c) {
+		c.String(http.StatusOK, dbserver.Status())
+		return
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	c.JSON(http.StatusOK, serverStats{
+		Uptime: uptime(),
+		Runtime: runtimeStats{
+			Goroutines:   runtime.NumGoroutine(),
+			NumCPU:       runtime.NumCPU(),
+			GOMAXPROCS:   runtime.GOMAXPROCS(0),
+			Alloc:        ms.Alloc,
+			TotalAlloc:   ms.TotalAlloc,
+			Sys:          ms.Sys,
+			HeapObjects:  ms.HeapObjects,
+			NumGC:        ms.NumGC,
+			PauseTotalMs: float64(ms.PauseTotalNs) / float64(time.Millisecond),
+		},
+		HttpServer: httpServerStats{Addr: server.addr()},
+		DBServer:   dbserver.Statuses(),
+	})
+}
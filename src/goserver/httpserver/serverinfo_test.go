@@ -0,0 +1,36 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestServerInfo(t *testing.T) {
+	for _, accept := range []string{"", "*/*", "application/json, text/plain"} {
+		w := serveAdmin("/serverinfo", accept)
+		var info serverInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatalf("Unexpected serverinfo for Accept %q: %q", accept, w.Body.String())
+		}
+		if info.Pid != os.Getpid() || info.Version != "unknown" || info.StartTime.IsZero() {
+			t.Fatalf("Unexpected serverinfo: %+v", info)
+		}
+	}
+
+	w := serveAdmin("/serverinfo", "text/plain;q=0.9, application/json;q=0.8")
+	if !strings.Contains(w.Header().Get("Content-Type"), "text/plain") || !strings.Contains(w.Body.String(), "Pid\t") {
+		t.Fatalf("Unexpected text serverinfo: %q", w.Body.String())
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	var stats serverStats
+	if err := json.Unmarshal(serveAdmin("/serverstats", "").Body.Bytes(), &stats); err != nil || stats.Runtime.Goroutines == 0 {
+		t.Fatalf("Unexpected serverstats: %+v %v", stats, err)
+	}
+	if body := serveAdmin("/serverstats", "text/plain").Body.String(); !strings.HasPrefix(body, "DBName\tRole\t") {
+		t.Fatalf("Unexpected text serverstats: %q", body)
+	}
+}
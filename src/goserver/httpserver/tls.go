@@ -0,0 +1,81 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"goserver/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+/*
+intermediateCiphers are the TLS 1.2 suites with forward secrecy and AEAD,
+TLS 1.3 suites are not configurable and always allowed.
+*/
+var intermediateCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+/*
+newTLSConfig reads the certificate files of httpserver, nil when
+cert_file is not set. It is called again on every reload, so renewed
+certificates are picked up by a SIGHUP.
+*/
+func newTLSConfig(c *config.Config) (*tls.Config, error) {
+	hc := c.HttpServer
+	if hc.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(hc.CertFile, hc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("httpserver load cert(%s) error:%s", hc.CertFile, err.Error())
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[hc.MinTLSVersion],
+		//handshakes use this config, not the one of http.Server that has h2 set
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if hc.Ciphers == "intermediate" {
+		tlsConfig.CipherSuites = intermediateCiphers
+	}
+
+	if hc.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(hc.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("httpserver load client ca(%s) error:%s", hc.ClientCAFile, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("httpserver load client ca(%s) error:no certificate found", hc.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if hc.ClientAuth != "" {
+		tlsConfig.ClientAuth = clientAuthModes[hc.ClientAuth]
+	}
+	return tlsConfig, nil
+}
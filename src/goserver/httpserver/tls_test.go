@@ -0,0 +1,187 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"goserver/config"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+/*
+newTestCert makes a certificate for 127.0.0.1 signed by parent, or a
+self-signed CA when parent is nil.
+*/
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, c.pem, 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func freePort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+/*
+handshake connects to addr trusting ca and returns the common name of
+the server certificate.
+*/
+func handshake(addr string, ca *testCert, client *testCert) (string, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if client != nil {
+		tlsConfig.Certificates = []tls.Certificate{client.tlsCertificate()}
+	}
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	//a rejected client certificate only shows on the first read with TLS 1.3
+	conn.Write([]byte("GET /healthz HTTP/1.0\r\n\r\n"))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem, 0600)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestCert(t, "first", ca).write(t, certFile, keyFile)
+
+	c := config.DefaultConfig()
+	c.HttpServer.Ip = "127.0.0.1"
+	c.HttpServer.Port = freePort(t)
+	c.HttpServer.CertFile = certFile
+	c.HttpServer.KeyFile = keyFile
+	c.Shutdown.Timeout = 1
+	addr := listenAddr(c)
+
+	Run(c)
+	defer Shutdown(context.Background())
+	if name, err := handshake(addr, ca, nil); err != nil || name != "first" {
+		t.Fatalf("Unexpected certificate. Found %q %v, expected first", name, err)
+	}
+
+	//HTTP/2 is negotiated
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Fatalf("Unexpected protocol. Found %q, expected h2", proto)
+	}
+	conn.Close()
+
+	//a reload reads renewed certificates without a rebind
+	newTestCert(t, "second", ca).write(t, certFile, keyFile)
+	if err := Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := handshake(addr, ca, nil); err != nil || name != "second" {
+		t.Fatalf("Unexpected certificate after reload. Found %q %v, expected second", name, err)
+	}
+
+	//mutual TLS
+	c.HttpServer.ClientCAFile = filepath.Join(dir, "ca.pem")
+	if err := Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(addr, ca, nil); err == nil {
+		t.Fatal("Expected a handshake without client certificate to fail")
+	}
+	if _, err := handshake(addr, ca, newTestCert(t, "client", ca)); err != nil {
+		t.Fatalf("Unexpected handshake error with a client certificate: %v", err)
+	}
+
+	//a broken certificate is rejected and the running one kept
+	ioutil.WriteFile(certFile, []byte("broken"), 0600)
+	if err := Reload(c); err == nil {
+		t.Fatal("Expected a reload with a broken certificate to fail")
+	}
+	if _, err := handshake(addr, ca, newTestCert(t, "client", ca)); err != nil {
+		t.Fatalf("Unexpected handshake error after a rejected reload: %v", err)
+	}
+
+	//switching TLS off rebinds the same address for plain http
+	c.HttpServer.CertFile, c.HttpServer.KeyFile, c.HttpServer.ClientCAFile = "", "", ""
+	if err := Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
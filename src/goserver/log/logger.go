@@ -4,14 +4,40 @@ import (
 	"fmt"
 	"github.com/cihub/seelog"
 	"goserver/config"
+	"sync"
 )
 
 var Logger seelog.LoggerInterface
 
+/*
+slowLogger writes the slow query log, nil sends it to Logger.
+Writers hold slowLock for reading while they use it, so a reload only
+closes the old one once nobody writes to it anymore.
+*/
+var slowLogger seelog.LoggerInterface
+var slowLock sync.RWMutex
+
 func init() {
 }
 
 func SetupLoggerFromConfig(c *config.Config) {
+	logger, err := NewLoggerFromConfig(c)
+	if err != nil {
+		panic(err)
+	}
+	slow, err := NewSlowLoggerFromConfig(c)
+	if err != nil {
+		panic(err)
+	}
+	ReplaceLogger(logger)
+	ReplaceSlowLogger(slow)
+}
+
+/*
+NewLoggerFromConfig builds a logger without installing it, so a reload
+can check the logging section before anything is swapped.
+*/
+func NewLoggerFromConfig(c *config.Config) (seelog.LoggerInterface, error) {
 	logConfigTmp := `
 		<seelog minlevel="%s">
 			<outputs formatid="common">
@@ -34,10 +60,48 @@ func SetupLoggerFromConfig(c *config.Config) {
 		c.Logging.ErrorFilename,
 		"%Date/%Time [%LEV] %Msg%n",
 		"%Date/%Time %File %FullPath %Func %Msg%n")
-	logger, err := seelog.LoggerFromConfigAsBytes([]byte(logConfig))
-	if err != nil {
-		panic(err)
+	return seelog.LoggerFromConfigAsBytes([]byte(logConfig))
+}
+
+/*
+NewSlowLoggerFromConfig builds the slow query logger, nil when
+logging.slowfilename is empty.
+*/
+func NewSlowLoggerFromConfig(c *config.Config) (seelog.LoggerInterface, error) {
+	if c.Logging.SlowFilename == "" {
+		return nil, nil
 	}
+	logConfigTmp := `
+		<seelog minlevel="info">
+			<outputs formatid="slow">
+				<rollingfile type="size" filename="%s" maxsize="%d" maxrolls="%d" />
+			</outputs>
+			<formats>
+				<format id="slow" format="%s" />
+			</formats>
+		</seelog>
+	`
+	logConfig := fmt.Sprintf(logConfigTmp,
+		c.Logging.SlowFilename,
+		c.Logging.Maxsize,
+		c.Logging.Maxrolls,
+		"%Date/%Time [%LEV] %Msg%n")
+	return seelog.LoggerFromConfigAsBytes([]byte(logConfig))
+}
+
+func ReplaceSlowLogger(logger seelog.LoggerInterface) {
+	slowLock.Lock()
+	old := slowLogger
+	slowLogger = logger
+	slowLock.Unlock()
+
+	if old != nil {
+		old.Flush()
+		old.Close()
+	}
+}
+
+func ReplaceLogger(logger seelog.LoggerInterface) {
 	//seelog.ReplaceLogger(logger)
 	seelog.Current.Flush()
 	seelog.Current.Close()
@@ -45,7 +109,34 @@ func SetupLoggerFromConfig(c *config.Config) {
 	Logger = logger
 }
 
-func Flush() { seelog.Flush() }
+func Flush() {
+	seelog.Flush()
+	slowLock.RLock()
+	defer slowLock.RUnlock()
+	if slowLogger != nil {
+		slowLogger.Flush()
+	}
+}
+
+func SlowWarnf(msg string, vals ...interface{}) {
+	slowLock.RLock()
+	defer slowLock.RUnlock()
+	if slowLogger == nil {
+		seelog.Warnf(msg, vals...)
+		return
+	}
+	slowLogger.Warnf(msg, vals...)
+}
+
+func SlowInfof(msg string, vals ...interface{}) {
+	slowLock.RLock()
+	defer slowLock.RUnlock()
+	if slowLogger == nil {
+		seelog.Infof(msg, vals...)
+		return
+	}
+	slowLogger.Infof(msg, vals...)
+}
 
 func Critical(msg ...interface{}) { seelog.Critical(msg) }
 func Fatal(msg ...interface{})    { seelog.Critical(msg) }
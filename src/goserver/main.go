@@ -3,12 +3,13 @@ package main
 import (
 	"flag"
 	"fmt"
-	"net/http"
 	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/VividCortex/godaemon"
 
@@ -17,42 +18,152 @@ import (
 	"goserver/goserver"
 	"goserver/httpserver"
 	"goserver/log"
+	"goserver/migrate"
 )
 
 var cmdargConfigFile string
 var cmdargSignal string
+var cmdargTest bool
+var cmdargSets stringList
 var serverconfig *config.Config
 
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func init() {
 	flag.StringVar(&cmdargConfigFile, "c", "", "Configuration File")
 	flag.StringVar(&cmdargSignal, "s", "", "Send Signal To Server")
+	flag.BoolVar(&cmdargTest, "t", false, "Test Configuration File And Exit")
+	flag.Var(&cmdargSets, "set", "Override Config Key, like httpserver.port=9999, Can Be Repeated")
 	flag.Parse()
 }
 
 func SigHupHandler() {
-	/*
-		if cmdargConfigFile != "" {
-			serverconfig = config.InitConfigFromFile(cmdargConfigFile)
-		} else {
-			serverconfig = config.DefaultConfig()
+	if err := reloadConfig(cmdargConfigFile); err != nil {
+		log.Errorf("reload config(%s) rejected: %s", cmdargConfigFile, err.Error())
+	}
+}
+
+/*
+reloadConfig checks everything that can fail before applying anything,
+so a rejected config leaves the running one untouched.
+The logger is always rebuilt, which also reopens the log files, and the
+certificates of an https httpserver are always read again.
+*/
+func reloadConfig(path string) error {
+	newconfig, err := config.LoadConfigFromFile(path, cmdargSets...)
+	if err != nil {
+		return err
+	}
+	diff := config.Diff(config.CurConfig(), newconfig)
+
+	logger, err := log.NewLoggerFromConfig(newconfig)
+	if err != nil {
+		return err
+	}
+	slowLogger, err := log.NewSlowLoggerFromConfig(newconfig)
+	if err != nil {
+		logger.Close()
+		return err
+	}
+	if err := httpserver.Reload(newconfig); err != nil {
+		logger.Close()
+		if slowLogger != nil {
+			slowLogger.Close()
 		}
-	*/
-	log.SetupLoggerFromConfig(serverconfig)
+		return err
+	}
+	log.ReplaceLogger(logger)
+	log.ReplaceSlowLogger(slowLogger)
+	//before dbserver, its reconnect errors are redacted with the new secrets
+	config.SetCurConfig(newconfig)
+	dbserver.Reload(newconfig, diff)
+
+	for _, section := range diff.Restart {
+		log.Warnf("config %s changed, restart to apply", section)
+	}
+	log.Infof("reload config(%s): %s", path, diff)
+	return nil
 }
 
 func SigIntHandler() {
-	goserver.RemovePidFile()
+	c := config.CurConfig()
+	goserver.Shutdown(time.Duration(c.Shutdown.Delay)*time.Second, time.Duration(c.Shutdown.Timeout)*time.Second)
 	os.Exit(0)
 }
 
-func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
+/*
+testConfig works like nginx -t: it prints every problem in the config
+file and returns the exit code.
+*/
+func testConfig(path string) int {
+	if _, err := config.LoadConfigFromFile(path, cmdargSets...); err != nil {
+		printConfigError(path, err)
+		fmt.Printf("configuration file %s test failed\n", configName(path))
+		return 1
+	}
+	fmt.Printf("configuration file %s syntax is ok\n", configName(path))
+	fmt.Printf("configuration file %s test is successful\n", configName(path))
+	return 0
+}
 
-	//初始化配置
-	serverconfig = config.DefaultConfig()
-	if cmdargConfigFile != "" {
-		serverconfig = config.InitConfigFromFile(cmdargConfigFile)
+/*
+migrateCommand runs `goserver migrate up|down|status`, its flags come
+after the action: goserver migrate up -c config/config.yml -db mysql1
+*/
+func migrateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: goserver migrate up|down|status [-c config file] [-db DBName]")
+		return 2
 	}
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&cmdargConfigFile, "c", cmdargConfigFile, "Configuration File")
+	flags.Var(&cmdargSets, "set", "Override Config Key, like dbserver.migrations_dir=db, Can Be Repeated")
+	dbname := flags.String("db", "", "Only Migrate This DBName")
+	flags.Parse(args[1:])
+
+	c, err := config.LoadConfigFromFile(cmdargConfigFile, cmdargSets...)
+	if err != nil {
+		printConfigError(cmdargConfigFile, err)
+		return 1
+	}
+	config.SetCurConfig(c)
+
+	if err := migrate.Command(c, args[0], *dbname, os.Stdout); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	return 0
+}
+
+func configName(path string) string {
+	if path == "" {
+		return "(default)"
+	}
+	return path
+}
+
+func printConfigError(path string, err error) {
+	path = configName(path)
+	if errs, ok := err.(config.ValidationErrors); ok {
+		for _, e := range errs {
+			fmt.Printf("%s: %s\n", path, e.Error())
+		}
+		return
+	}
+	fmt.Printf("%s: %s\n", path, err.Error())
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	//处理命令行信号
 	if cmdargSignal != "" {
@@ -66,38 +177,54 @@ func main() {
 			cmd := exec.Command("kill", "-s", "SIGQUIT", strconv.Itoa(pid))
 			cmd.Run()
 			break
-		case "reopen":
-			println("received reopen:" + strconv.Itoa(pid))
+		case "reopen", "reload":
+			println("received " + cmdargSignal + ":" + strconv.Itoa(pid))
 			cmd := exec.Command("kill", "-s", "SIGHUP", strconv.Itoa(pid))
 			cmd.Run()
 			break
 		default:
-			fmt.Println("signal argument: quit")
+			fmt.Println("signal argument: quit, reload, reopen")
 		}
 		os.Exit(0)
 	}
 
+	//检查配置
+	if cmdargTest {
+		os.Exit(testConfig(cmdargConfigFile))
+	}
+
+	//数据库迁移
+	if flag.Arg(0) == "migrate" {
+		os.Exit(migrateCommand(flag.Args()[1:]))
+	}
+
+	//初始化配置: 默认值 < 配置文件 < 环境变量 < -set
+	var err error
+	serverconfig, err = config.InitConfigFromFile(cmdargConfigFile, cmdargSets...)
+	if err != nil {
+		printConfigError(cmdargConfigFile, err)
+		os.Exit(1)
+	}
+
 	//初始化日志
 	log.SetupLoggerFromConfig(serverconfig)
 
 	//初始化基础服务
 	goserver.SetSignalHandler(SigHupHandler, syscall.SIGHUP)
 	goserver.SetSignalHandler(SigIntHandler, syscall.SIGINT)
+	goserver.SetSignalHandler(SigIntHandler, syscall.SIGTERM)
+	goserver.SetSignalHandler(SigIntHandler, syscall.SIGQUIT)
+	//退出时先停HTTP服务，再关闭数据库
+	goserver.AddShutdownHook("httpserver", httpserver.Shutdown)
+	goserver.AddShutdownHook("dbserver", dbserver.Shutdown)
 	go goserver.Run()
 
 	//初始化数据库
 	dbserver.Run(serverconfig)
 
-	//启动HTTP服务
+	//启动HTTP服务和管理服务
 	httpserver.Run(serverconfig)
 
-	//启动pprof，用于性能分析
-	if serverconfig.Pprof.Switch == "on" {
-		go func() {
-			http.ListenAndServe(fmt.Sprintf("%s:%d", serverconfig.Pprof.Ip, serverconfig.Pprof.Port), nil)
-		}()
-	}
-
 	//以Daemon方式运行
 	if serverconfig.Daemon.Switch == "on" {
 		godaemon.MakeDaemon(&godaemon.DaemonAttr{})
@@ -0,0 +1,291 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+/*
+DefBuckets are the upper bounds in seconds used for latencies.
+*/
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+/*
+Family is a snapshot of one metric with all its label values, what
+an exporter walks over. Buckets are the upper bounds of a histogram,
++Inf excluded.
+*/
+type Family struct {
+	Name       string
+	Help       string
+	Type       string
+	LabelNames []string
+	Buckets    []float64
+	Metrics    []Metric
+}
+
+/*
+Metric is one set of label values of a Family. Counters and gauges have
+Value, histograms have the cumulative BucketCounts, Count and Sum.
+*/
+type Metric struct {
+	LabelValues  []string
+	Value        float64
+	BucketCounts []uint64
+	Count        uint64
+	Sum          float64
+}
+
+/*
+A Collector returns its families on every Gather, gauges read from
+somewhere else are a CollectorFunc.
+*/
+type Collector interface {
+	Collect() []Family
+}
+
+type CollectorFunc func() []Family
+
+func (f CollectorFunc) Collect() []Family {
+	return f()
+}
+
+/*
+Registry is safe for concurrent use.
+*/
+type Registry struct {
+	lock       sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+var defaultRegistry = NewRegistry()
+
+func Register(c Collector) {
+	defaultRegistry.Register(c)
+}
+
+func Gather() []Family {
+	return defaultRegistry.Gather()
+}
+
+func (r *Registry) Register(c Collector) {
+	r.lock.Lock()
+	r.collectors = append(r.collectors, c)
+	r.lock.Unlock()
+}
+
+/*
+Gather collects every family, sorted by name.
+*/
+func (r *Registry) Gather() []Family {
+	r.lock.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.lock.Unlock()
+
+	var families []Family
+	for _, c := range collectors {
+		families = append(families, c.Collect()...)
+	}
+	sort.SliceStable(families, func(i, j int) bool { return families[i].Name < families[j].Name })
+	return families
+}
+
+/*
+Label values are joined with a byte that can't be in a valid UTF-8
+string to key the children of a vec.
+*/
+const labelSep = "\xff"
+
+type vec struct {
+	name       string
+	help       string
+	labelNames []string
+	lock       sync.RWMutex
+	children   map[string]interface{}
+	values     map[string][]string
+}
+
+func newVec(name, help string, labelNames []string) vec {
+	return vec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		children:   make(map[string]interface{}),
+		values:     make(map[string][]string),
+	}
+}
+
+func (v *vec) child(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, labelSep)
+	v.lock.RLock()
+	c, ok := v.children[key]
+	v.lock.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if c, ok := v.children[key]; ok {
+		return c
+	}
+	c = create()
+	v.children[key] = c
+	v.values[key] = append([]string(nil), labelValues...)
+	return c
+}
+
+/*
+each calls fn for the children sorted by label values.
+*/
+func (v *vec) each(fn func(labelValues []string, c interface{})) {
+	v.lock.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fn(v.values[key], v.children[key])
+	}
+	v.lock.RUnlock()
+}
+
+type Counter struct {
+	bits uint64 //math.Float64bits of the value
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+/*
+Add panics on a negative v, a counter only goes up.
+*/
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	addFloat(&c.bits, v)
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		if atomic.CompareAndSwapUint64(bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+type CounterVec struct {
+	vec
+}
+
+/*
+NewCounterVec registers a counter in the default registry.
+*/
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{newVec(name, help, labelNames)}
+	Register(v)
+	return v
+}
+
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return v.child(labelValues, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (v *CounterVec) Collect() []Family {
+	f := Family{Name: v.name, Help: v.help, Type: TypeCounter, LabelNames: v.labelNames}
+	v.each(func(labelValues []string, c interface{}) {
+		f.Metrics = append(f.Metrics, Metric{LabelValues: labelValues, Value: c.(*Counter).Value()})
+	})
+	return []Family{f}
+}
+
+/*
+Histogram counts observations in buckets by upper bound, an observation
+above the last bound is only in Count.
+*/
+type Histogram struct {
+	buckets []float64
+	lock    sync.Mutex
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.lock.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.lock.Unlock()
+}
+
+func (h *Histogram) metric(labelValues []string) Metric {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	m := Metric{LabelValues: labelValues, BucketCounts: make([]uint64, len(h.counts)), Count: h.count, Sum: h.sum}
+	var cumulative uint64
+	for i, n := range h.counts {
+		cumulative += n
+		m.BucketCounts[i] = cumulative
+	}
+	return m
+}
+
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+/*
+NewHistogramVec registers a histogram in the default registry, buckets
+must be sorted.
+*/
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	v := &HistogramVec{newVec(name, help, labelNames), buckets}
+	Register(v)
+	return v
+}
+
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return v.child(labelValues, func() interface{} { return newHistogram(v.buckets) }).(*Histogram)
+}
+
+func (v *HistogramVec) Collect() []Family {
+	f := Family{Name: v.name, Help: v.help, Type: TypeHistogram, LabelNames: v.labelNames, Buckets: v.buckets}
+	v.each(func(labelValues []string, c interface{}) {
+		f.Metrics = append(f.Metrics, c.(*Histogram).metric(labelValues))
+	})
+	return []Family{f}
+}
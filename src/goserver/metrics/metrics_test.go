@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	v := NewCounterVec("test_total", "help", "a", "b")
+	v.With("x", "2").Inc()
+	v.With("x", "1").Add(2.5)
+	v.With("x", "2").Inc()
+
+	f := v.Collect()[0]
+	if f.Type != TypeCounter || len(f.Metrics) != 2 {
+		t.Fatalf("Unexpected family: %+v", f)
+	}
+	if !reflect.DeepEqual(f.Metrics[0].LabelValues, []string{"x", "1"}) || f.Metrics[0].Value != 2.5 || f.Metrics[1].Value != 2 {
+		t.Fatalf("Unexpected metrics: %+v", f.Metrics)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	v := NewHistogramVec("test_seconds", "help", []float64{1, 2}, "op")
+	for _, x := range []float64{0.5, 1, 1.5, 3} {
+		v.With("q").Observe(x)
+	}
+
+	m := v.Collect()[0].Metrics[0]
+	if !reflect.DeepEqual(m.BucketCounts, []uint64{2, 3}) || m.Count != 4 || m.Sum != 6 {
+		t.Fatalf("Unexpected histogram: %+v", m)
+	}
+}
+
+func TestGather(t *testing.T) {
+	r := NewRegistry()
+	r.Register(CollectorFunc(func() []Family { return []Family{{Name: "b"}, {Name: "a"}} }))
+	r.Register(CollectorFunc(func() []Family { return []Family{{Name: "c"}} }))
+
+	names := []string{}
+	for _, f := range r.Gather() {
+		names = append(names, f.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b", "c"}) {
+		t.Fatalf("Unexpected families. Found %v, expected a b c", names)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	families := []Family{
+		{Name: "empty", Type: TypeGauge},
+		{Name: "g", Help: "a\\b\nc", Type: TypeGauge, LabelNames: []string{"l"},
+			Metrics: []Metric{{LabelValues: []string{"q\"\n"}, Value: 1.5}}},
+		{Name: "h", Type: TypeHistogram, Buckets: []float64{0.5, 1},
+			Metrics: []Metric{{BucketCounts: []uint64{1, 2}, Count: 3, Sum: 2.25}}},
+	}
+	var buf bytes.Buffer
+	if err := WriteText(&buf, families); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP g a\\b\nc
+# TYPE g gauge
+g{l="q\"\n"} 1.5
+# HELP h 
+# TYPE h histogram
+h_bucket{le="0.5"} 1
+h_bucket{le="1"} 2
+h_bucket{le="+Inf"} 3
+h_sum 2.25
+h_count 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected text. Found:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
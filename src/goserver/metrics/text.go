@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+ContentType is the Prometheus text exposition format written by WriteText.
+*/
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+/*
+WriteText writes families in the Prometheus text exposition format,
+families without metrics are left out.
+*/
+func WriteText(w io.Writer, families []Family) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		if len(f.Metrics) == 0 {
+			continue
+		}
+		bw.WriteString("# HELP " + f.Name + " " + helpEscaper.Replace(f.Help) + "\n")
+		bw.WriteString("# TYPE " + f.Name + " " + f.Type + "\n")
+		for _, m := range f.Metrics {
+			if f.Type != TypeHistogram {
+				writeSample(bw, f.Name, f.LabelNames, m.LabelValues, "", "", m.Value)
+				continue
+			}
+			for i, bound := range f.Buckets {
+				writeSample(bw, f.Name+"_bucket", f.LabelNames, m.LabelValues, "le", formatFloat(bound), float64(m.BucketCounts[i]))
+			}
+			writeSample(bw, f.Name+"_bucket", f.LabelNames, m.LabelValues, "le", "+Inf", float64(m.Count))
+			writeSample(bw, f.Name+"_sum", f.LabelNames, m.LabelValues, "", "", m.Sum)
+			writeSample(bw, f.Name+"_count", f.LabelNames, m.LabelValues, "", "", float64(m.Count))
+		}
+	}
+	return bw.Flush()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+/*
+writeSample writes one line, extraName is the le label of a bucket.
+*/
+func writeSample(w *bufio.Writer, name string, labelNames, labelValues []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labelNames) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + labelEscaper.Replace(labelValues[i]) + `"`)
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
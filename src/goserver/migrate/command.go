@@ -0,0 +1,105 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"goserver/config"
+)
+
+/*
+Command runs one action of `goserver migrate up|down|status` on every
+dbitem of c, or only on dbname when it is not empty. It stops at the
+first error. Dbitems without migrations are skipped.
+*/
+func Command(c *config.Config, action, dbname string, w io.Writer) error {
+	if action != "up" && action != "down" && action != "status" {
+		return fmt.Errorf("unknown migrate action %q, want up, down or status", action)
+	}
+
+	found := false
+	for _, item := range c.DBServer.DBItems {
+		if dbname != "" && item.DBName != dbname {
+			continue
+		}
+		found = true
+
+		dir := filepath.Join(c.DBServer.MigrationsDir, item.DBName)
+		migrations, err := Load(dir)
+		if err != nil {
+			return fmt.Errorf("db(%s) %s", item.DBName, err.Error())
+		}
+		if len(migrations) == 0 {
+			fmt.Fprintf(w, "db(%s) no migrations in %s\n", item.DBName, dir)
+			continue
+		}
+
+		if err := command(item, migrations, action, w); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("db(%s) not found in dbserver.dbitems", dbname)
+	}
+	return nil
+}
+
+func command(item config.DBItemConfig, migrations []Migration, action string, w io.Writer) error {
+	db, err := sql.Open(item.DriverName, item.DataSourceName)
+	if err != nil {
+		return fmt.Errorf("db(%s) open(%s) error:%s", item.DBName, config.RedactDSN(item.DataSourceName), config.RedactString(err.Error()))
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("db(%s) ping(%s) error:%s", item.DBName, config.RedactDSN(item.DataSourceName), config.RedactString(err.Error()))
+	}
+
+	m := &Migrator{
+		DBName:     item.DBName,
+		DriverName: item.DriverName,
+		DB:         db,
+		Migrations: migrations,
+	}
+
+	switch action {
+	case "up":
+		done, err := m.Up()
+		for _, migration := range done {
+			fmt.Fprintf(w, "db(%s) applied %s\n", item.DBName, migration)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Fprintf(w, "db(%s) is up to date\n", item.DBName)
+		}
+	case "down":
+		migration, err := m.Down()
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			fmt.Fprintf(w, "db(%s) has no migration to roll back\n", item.DBName)
+		} else {
+			fmt.Fprintf(w, "db(%s) rolled back %s\n", item.DBName, migration)
+		}
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			switch {
+			case s.Up == "":
+				fmt.Fprintf(w, "db(%s) %04d\tapplied %s, no files\n", item.DBName, s.Version, s.AppliedAt)
+			case s.AppliedAt == "":
+				fmt.Fprintf(w, "db(%s) %s\tpending\n", item.DBName, s.Migration)
+			default:
+				fmt.Fprintf(w, "db(%s) %s\tapplied %s\n", item.DBName, s.Migration, s.AppliedAt)
+			}
+		}
+	}
+	return nil
+}
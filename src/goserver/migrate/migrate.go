@@ -0,0 +1,284 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"goserver/config"
+)
+
+/*
+Migrations of a database live in their own directory, named after the
+DBName of its dbitem:
+
+	migrations/mysql1/0001_create_user.up.sql
+	migrations/mysql1/0001_create_user.down.sql
+	migrations/mysql1/0002_add_user_email.up.sql
+
+Versions are applied in order and recorded in the schema_migrations table
+of the database. The down file is optional, without it the version can't
+be rolled back.
+*/
+type Migration struct {
+	Version int
+	Name    string
+	Up      string //file names
+	Down    string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+var fileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+/*
+Load reads the migration files of dir, sorted by version.
+A missing dir is no migrations.
+*/
+func Load(dir string) ([]Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	prefixes := make(map[int]string) //0001 and 1 are the same version
+	for _, f := range files {
+		match := fileRegexp.FindStringSubmatch(f.Name())
+		if f.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+			prefixes[version] = match[1]
+		} else if m.Name != match[2] || prefixes[version] != match[1] {
+			return nil, fmt.Errorf("migration %s: version %d is also used by %s_%s", f.Name(), version, prefixes[version], m.Name)
+		}
+		path := filepath.Join(dir, f.Name())
+		if match[3] == "up" {
+			m.Up = path
+		} else {
+			m.Down = path
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %s: no up file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+/*
+MySQL commits implicitly around DDL, so there a migration that fails
+halfway stays half applied and has to be fixed by hand. SQLite can roll
+DDL back, its migrations run in one transaction with their bookkeeping.
+*/
+var transactional = map[string]bool{
+	"sqlite3": true,
+}
+
+const createTable = `create table if not exists schema_migrations (
+	version bigint not null primary key,
+	name varchar(255) not null,
+	applied_at varchar(32) not null
+)`
+
+/*
+Migrator applies the migrations of one database.
+*/
+type Migrator struct {
+	DBName     string
+	DriverName string
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+func NewMigrator(dbname, driverName string, db *sql.DB, dir string) (*Migrator, error) {
+	migrations, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		DBName:     dbname,
+		DriverName: driverName,
+		DB:         db,
+		Migrations: migrations,
+	}, nil
+}
+
+/*
+Applied returns the applied versions and when they were applied.
+*/
+func (m *Migrator) Applied() (map[int]string, error) {
+	if _, err := m.DB.Exec(createTable); err != nil {
+		return nil, fmt.Errorf("db(%s) create schema_migrations error:%s", m.DBName, config.RedactString(err.Error()))
+	}
+	rows, err := m.DB.Query("select version, applied_at from schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("db(%s) query schema_migrations error:%s", m.DBName, config.RedactString(err.Error()))
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("db(%s) scan schema_migrations error:%s", m.DBName, err.Error())
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+/*
+Up applies every pending migration in order and returns those applied.
+It stops at the first one that fails.
+*/
+func (m *Migrator) Up() ([]Migration, error) {
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, migration := range m.Migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := m.run(migration, migration.Up,
+			"insert into schema_migrations(version, name, applied_at) values(?, ?, ?)",
+			migration.Version, migration.Name, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+/*
+Down rolls back the latest applied migration, nil when none is applied.
+*/
+func (m *Migrator) Down() (*Migration, error) {
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+
+	latest := -1
+	for version := range applied {
+		if version > latest {
+			latest = version
+		}
+	}
+	if latest < 0 {
+		return nil, nil
+	}
+
+	for _, migration := range m.Migrations {
+		if migration.Version != latest {
+			continue
+		}
+		if migration.Down == "" {
+			return nil, fmt.Errorf("db(%s) migration %s: no down file", m.DBName, migration)
+		}
+		err := m.run(migration, migration.Down, "delete from schema_migrations where version=?", migration.Version)
+		if err != nil {
+			return nil, err
+		}
+		return &migration, nil
+	}
+	return nil, fmt.Errorf("db(%s) migration %04d is applied but has no files", m.DBName, latest)
+}
+
+/*
+run executes the statements of file and then the bookkeeping statement,
+in one transaction when the driver can roll DDL back.
+*/
+func (m *Migrator) run(migration Migration, file string, bookkeeping string, args ...interface{}) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("db(%s) migration %s: %s", m.DBName, migration, err.Error())
+	}
+	statements := splitStatements(m.DriverName, string(content))
+
+	if !transactional[m.DriverName] {
+		for i, statement := range statements {
+			if _, err := m.DB.Exec(statement); err != nil {
+				return fmt.Errorf("db(%s) migration %s statement %d error:%s, statements before it are applied, fix them by hand",
+					m.DBName, migration, i+1, config.RedactString(err.Error()))
+			}
+		}
+		if _, err := m.DB.Exec(bookkeeping, args...); err != nil {
+			return fmt.Errorf("db(%s) migration %s bookkeeping error:%s", m.DBName, migration, config.RedactString(err.Error()))
+		}
+		return nil
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("db(%s) begin error:%s", m.DBName, config.RedactString(err.Error()))
+	}
+	for i, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("db(%s) migration %s statement %d error:%s, rolled back",
+				m.DBName, migration, i+1, config.RedactString(err.Error()))
+		}
+	}
+	if _, err := tx.Exec(bookkeeping, args...); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("db(%s) migration %s bookkeeping error:%s, rolled back", m.DBName, migration, config.RedactString(err.Error()))
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("db(%s) migration %s commit error:%s", m.DBName, migration, config.RedactString(err.Error()))
+	}
+	return nil
+}
+
+type Status struct {
+	Migration
+	AppliedAt string //empty when pending
+}
+
+/*
+Status lists every migration with when it was applied. Versions that are
+applied but have no files are listed too, with only Version set.
+*/
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, migration := range m.Migrations {
+		statuses = append(statuses, Status{Migration: migration, AppliedAt: applied[migration.Version]})
+		delete(applied, migration.Version)
+	}
+	for version, appliedAt := range applied {
+		statuses = append(statuses, Status{Migration: Migration{Version: version}, AppliedAt: appliedAt})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
@@ -0,0 +1,173 @@
+package migrate
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestMigrator(t *testing.T, files map[string]string) (*Migrator, func()) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, files)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMigrator("test", "sqlite3", db, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func assertTables(t *testing.T, db *sql.DB, expected []string) {
+	rows, err := db.Query("select name from sqlite_master where type='table' and name<>'schema_migrations' order by name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		tables = append(tables, name)
+	}
+	if !reflect.DeepEqual(tables, expected) {
+		t.Fatalf("Unexpected tables. Found %v, expected %v", tables, expected)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	m, cleanup := newTestMigrator(t, map[string]string{
+		"0001_create_user.up.sql":   "create table user(id integer, name text); -- users\ninsert into user values(1, 'a;b');",
+		"0001_create_user.down.sql": "drop table user;",
+		"0002_create_log.up.sql":    "create table log(id integer);",
+		"0002_create_log.down.sql":  "drop table log;",
+		"README":                    "not a migration",
+	})
+	defer cleanup()
+
+	done, err := m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 || done[0].String() != "0001_create_user" || done[1].String() != "0002_create_log" {
+		t.Fatalf("Unexpected applied migrations: %v", done)
+	}
+	assertTables(t, m.DB, []string{"log", "user"})
+
+	if done, err := m.Up(); err != nil || len(done) != 0 {
+		t.Fatalf("Unexpected second Up. Found %v %v, expected nothing applied", done, err)
+	}
+
+	migration, err := m.Down()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migration == nil || migration.Version != 2 {
+		t.Fatalf("Unexpected rolled back migration: %v", migration)
+	}
+	assertTables(t, m.DB, []string{"user"})
+
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0].AppliedAt == "" || statuses[1].AppliedAt != "" {
+		t.Fatalf("Unexpected status: %+v", statuses)
+	}
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	m, cleanup := newTestMigrator(t, map[string]string{
+		"0001_create_user.up.sql": "create table user(id integer);",
+		"0002_broken.up.sql":      "create table log(id integer); insert into nosuchtable values(1);",
+	})
+	defer cleanup()
+
+	done, err := m.Up()
+	if err == nil {
+		t.Fatal("Expected the broken migration to fail")
+	}
+	if len(done) != 1 {
+		t.Fatalf("Unexpected applied migrations: %v", done)
+	}
+	assertTables(t, m.DB, []string{"user"})
+
+	applied, err := m.Applied()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := applied[2]; ok || len(applied) != 1 {
+		t.Fatalf("Unexpected applied versions: %v", applied)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{"0001_a.down.sql": ""})
+	if _, err := Load(dir); err == nil {
+		t.Fatal("Expected an error for a migration without up file")
+	}
+
+	writeFiles(t, dir, map[string]string{"0001_a.up.sql": "", "0001_b.up.sql": ""})
+	if _, err := Load(dir); err == nil {
+		t.Fatal("Expected an error for a version used twice")
+	}
+	os.Remove(filepath.Join(dir, "0001_b.up.sql"))
+
+	writeFiles(t, dir, map[string]string{"1_a.down.sql": ""})
+	if _, err := Load(dir); err == nil {
+		t.Fatal("Expected an error for 0001_a and 1_a")
+	}
+
+	if migrations, err := Load(filepath.Join(dir, "nosuchdir")); err != nil || migrations != nil {
+		t.Fatalf("Unexpected Load of a missing dir: %v %v", migrations, err)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		driverName string
+		content    string
+		expected   []string
+	}{
+		{"mysql", "create table a(x text default ';');\n/* a; b */ insert into a values(\"\\\";\"); # c;\n`a;b`",
+			[]string{"create table a(x text default ';')", "insert into a values(\"\\\";\")", "`a;b`"}},
+		{"mysql", "select/* c */1;select 1--c;\n", []string{"select 1", "select 1"}},
+		{"mysql", "/*!40101 SET NAMES utf8; */;create table a(x int) /*!50100 ENGINE=InnoDB */;",
+			[]string{"/*!40101 SET NAMES utf8; */", "create table a(x int) /*!50100 ENGINE=InnoDB */"}},
+		{"sqlite3", "select '#';select 1 # 2;", []string{"select '#'", "select 1 # 2"}},
+		{"sqlite3", "insert into a values('a\\');select 2", []string{"insert into a values('a\\')", "select 2"}},
+	}
+	for _, test := range tests {
+		if statements := splitStatements(test.driverName, test.content); !reflect.DeepEqual(statements, test.expected) {
+			t.Fatalf("Unexpected %s statements of %q. Found %q, expected %q", test.driverName, test.content, statements, test.expected)
+		}
+	}
+}
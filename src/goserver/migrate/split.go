@@ -0,0 +1,75 @@
+package migrate
+
+import (
+	"bytes"
+	"strings"
+)
+
+/*
+splitStatements splits a migration file on the semicolons that end its
+statements. Semicolons in quotes and comments don't count, so a file can
+be sent one statement at a time even to a MySQL without multiStatements.
+Triggers and procedures with semicolons in their body are not supported.
+
+Comments are replaced by a space so the words around them stay apart,
+except the MySQL executable comments starting with /*! which are kept
+as they are. # comments and backslash escapes in quotes are MySQL only, SQLite
+reads # and \ as they are.
+*/
+func splitStatements(driverName, content string) []string {
+	var statements []string
+	var current bytes.Buffer
+	var quote byte
+	mysql := driverName == "mysql"
+
+	flush := func() {
+		if s := strings.TrimSpace(current.String()); s != "" {
+			statements = append(statements, s)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case quote != 0:
+			current.WriteByte(c)
+			if c == '\\' && mysql && quote != '`' && i+1 < len(content) {
+				i++
+				current.WriteByte(content[i])
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			current.WriteByte(c)
+		case c == '-' && strings.HasPrefix(content[i:], "--"), c == '#' && mysql:
+			end := strings.IndexByte(content[i:], '\n')
+			if end < 0 {
+				i = len(content)
+			} else {
+				i += end
+				current.WriteByte('\n')
+			}
+		case c == '/' && strings.HasPrefix(content[i:], "/*"):
+			end := strings.Index(content[i+2:], "*/")
+			if end < 0 {
+				end = len(content)
+			} else {
+				end += i + 4
+			}
+			if strings.HasPrefix(content[i:], "/*!") {
+				current.WriteString(content[i:end])
+			} else {
+				current.WriteByte(' ')
+			}
+			i = end - 1
+		case c == ';':
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
@@ -0,0 +1,10 @@
+package version
+
+// Build information, set at link time by the Makefile:
+//
+//	go install -ldflags "-X goserver/pkg/version.GitVersion=v1.2.0 -X goserver/pkg/version.GitCommit=4a6bc4a"
+var (
+	GitVersion = "unknown"
+	GitCommit  = "unknown"
+	BuildDate  = "unknown"
+)